@@ -25,6 +25,20 @@ func (ec ErrorCode) Error() string {
 	return errorMessages[ec]
 }
 
+// Returned when the broker and this package disagree about the wire
+// protocol.  Depending on where it happens either only the affected request
+// fails or the whole connection is closed; see SimpleConsumer.Err.
+type ProtocolError struct {
+	// What we were doing when it happened
+	Op string
+	// What went wrong
+	Detail string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error during " + e.Op + ": " + e.Detail
+}
+
 type TopicPartition struct {
 	Topic     string
 	Partition Partition
@@ -58,6 +72,10 @@ const (
 	CompressionTypeNone   CompressionType = 0
 	CompressionTypeGZip   CompressionType = 1
 	CompressionTypeSnappy CompressionType = 2
+
+	// Never sent.  Asks for a produce request to go uncompressed even when
+	// the client has a default compression.
+	CompressionTypeForceNone CompressionType = -1
 )
 
 type Message []byte
@@ -67,7 +85,8 @@ type Messages []Message
 
 const (
 	// excluding length field
-	messageHeaderSize = 1 + 1 + 4 // magic, compression, checksum
+	messageHeaderSize       = 1 + 1 + 4 // magic, compression, checksum
+	legacyMessageHeaderSize = 1 + 4     // magic, checksum
 	// Including the length field
 	messageFullHeaderSize = 4 + messageHeaderSize
 )
@@ -0,0 +1,145 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// A message set sent as one wrapper message.  The payload is the compressed
+// encoding of the inner message set (without its length prefix)
+type wrappedMessages struct {
+	compression CompressionType
+	payload     Message
+}
+
+func (m *wrappedMessages) Len() int32 {
+	// Add 4 for the length overhead
+	return m.payload.Len() + 4
+}
+
+func (m *wrappedMessages) WriteTo(w io.Writer) (n int64, err error) {
+	if n, err = binwrite(w, m.Len()-4); err != nil {
+		return -1, err
+	}
+
+	var nn int64
+	if nn, err = writeMessage(w, m.compression, m.payload); err != nil {
+		return -1, err
+	}
+	n += nn
+	return
+}
+
+// A Codec turns the encoded message set inside a wrapper message into the
+// wrapper's payload and back.  Implementations must be safe for concurrent use.
+type Codec interface {
+	Compress(messageSet []byte) ([]byte, error)
+	Decompress(payload []byte) ([]byte, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[CompressionType]Codec{
+		CompressionTypeGZip:   gzipCodec{},
+		CompressionTypeSnappy: snappyCodec{},
+	}
+)
+
+// Registers codec for wrapper messages with the given compression
+// attribute, replacing any codec already registered for it.  Passing a nil
+// codec unregisters it.
+func RegisterCodec(compression CompressionType, codec Codec) {
+	if compression == CompressionTypeNone {
+		panic("kafka: cannot register a codec for CompressionTypeNone")
+	}
+
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+
+	if codec == nil {
+		delete(codecs, compression)
+	} else {
+		codecs[compression] = codec
+	}
+}
+
+// Returns the codec registered for compression
+func LookupCodec(compression CompressionType) (codec Codec, ok bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	codec, ok = codecs[compression]
+	return
+}
+
+func lookupCodec(compression CompressionType) (Codec, error) {
+	codec, ok := LookupCodec(compression)
+	if !ok {
+		return nil, fmt.Errorf("No codec registered for compression type %d", compression)
+	}
+	return codec, nil
+}
+
+// Encodes ms as a message set and compresses it
+func compressMessages(compression CompressionType, ms Messages) (Message, error) {
+	codec, err := lookupCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err = writeMessageSet(&buf, ms); err != nil {
+		return nil, err
+	}
+
+	return codec.Compress(buf.Bytes())
+}
+
+// Decompresses the payload of a wrapper message into the encoded inner
+// message set
+func decompressMessages(compression CompressionType, payload Message) ([]byte, error) {
+	codec, err := lookupCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.Decompress(payload)
+}
+
+// Writes each message without the leading message set length
+func writeMessageSet(w io.Writer, ms Messages) error {
+	for _, m := range ms {
+		if _, err := m.WriteTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Compress(messageSet []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(messageSet); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decompress(payload []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
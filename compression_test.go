@@ -0,0 +1,65 @@
+package kafka
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Stores the message set backwards so we can tell it went through the codec
+type reverseCodec struct{}
+
+func (reverseCodec) Compress(messageSet []byte) ([]byte, error) {
+	return reverse(messageSet), nil
+}
+
+func (reverseCodec) Decompress(payload []byte) ([]byte, error) {
+	return reverse(payload), nil
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func TestRegisterCodec(t *testing.T) {
+	const compressionTypeReverse CompressionType = 42
+
+	ms := Messages{[]byte("hello"), []byte("there")}
+
+	if _, err := compressMessages(compressionTypeReverse, ms); err == nil {
+		t.Fatal("Expected an error for an unregistered codec")
+	}
+
+	RegisterCodec(compressionTypeReverse, reverseCodec{})
+	defer RegisterCodec(compressionTypeReverse, nil)
+
+	if _, ok := LookupCodec(compressionTypeReverse); !ok {
+		t.Fatal("Codec was not registered")
+	}
+
+	payload, err := compressMessages(compressionTypeReverse, ms)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.NewBuffer(nil)
+	if err = writeMessageSet(expected, ms); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(payload, reverse(expected.Bytes())) {
+		t.Error("Payload was not produced by the registered codec")
+	}
+
+	inner, err := decompressMessages(compressionTypeReverse, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(inner, expected.Bytes()) {
+		t.Error("Decompressed message set does not match. got:", inner, "expected:", expected.Bytes())
+	}
+}
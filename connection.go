@@ -2,170 +2,585 @@ package kafka
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
+// A connection to a single broker.  Requests are pipelined and their
+// responses are matched up in the order they were sent.  A SimpleConsumer is
+// safe for concurrent use by multiple goroutines.  A caller cancelling its
+// context only gives up on its own request, unless it does so while the
+// request is half written, which leaves the connection unusable.
 type SimpleConsumer struct {
 	conn          net.Conn
 	rw            *bufio.ReadWriter
 	responseQueue chan responseJob
+
+	// Held while a request is queued and written so the order of the queue
+	// matches the order on the wire.  A channel so waiting for it can be
+	// abandoned.
+	writeLock chan struct{}
+	// Called by connWriter before the request being written first reaches
+	// the connection.  Protected by writeLock.
+	startWrite func()
+
+	// How long a request may take to write or to get its response.  0 means
+	// no limit.
+	ioTimeout time.Duration
+	// Requests still waiting for their response, protected by deadlineLock.
+	// Goes negative when a response beats its writer to counting it.
+	inFlight     int
+	deadlineLock sync.Mutex
+
+	// Used for produce requests that don't specify their own
+	compression  CompressionType
+	legacyFormat bool
+
+	mu     sync.Mutex
+	closed bool
+	// Why the connection stopped, once it has
+	err error
+	// Closed once err is set
+	done chan struct{}
+	// Requests on their way into responseQueue
+	senders sync.WaitGroup
 }
 
 const defaultQueueSize = 128
 
-func Dial(addr string) (c *SimpleConsumer, err error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-
-	respQueue := make(chan responseJob, defaultQueueSize)
-
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+// Returned by every call on a SimpleConsumer once it has been closed, and
+// sent to requests that were still waiting for their response
+var ErrClosed = errors.New("SimpleConsumer is closed")
 
-	c = &SimpleConsumer{
-		conn:          conn,
-		rw:            rw,
-		responseQueue: respQueue,
-	}
-
-	go c.readWorker()
+// Dials addr over TCP with the zero Dialer
+func Dial(addr string) (c *SimpleConsumer, err error) {
+	var d Dialer
+	return d.Dial(addr)
+}
 
-	return c, nil
+func newSimpleConsumer(conn net.Conn) (c *SimpleConsumer) {
+	var d Dialer
+	return d.newSimpleConsumer(conn)
 }
 
 // We are going to reuse the buffers for fetch and multifetch, so don't keep the slices around
 // This will yield one per message and close when it's done
 func (c *SimpleConsumer) MultiFetch(req MultiFetchRequest) (results FetchResponseChan, err error) {
+	return c.MultiFetchContext(context.Background(), req)
+}
 
-	resp := make(FetchResponseChan)
-	c.responseQueue <- &multiFetchResponseJob{
-		ch:  resp,
-		mfr: req,
-	}
-
-	if _, err = c.writeRequest(req); err != nil {
-		panic(err)
+// Like MultiFetch, but gives up once ctx is done.  If that happens after the
+// request was sent the channel is closed early, the last value carrying
+// ctx.Err() if the caller was waiting on it.
+func (c *SimpleConsumer) MultiFetchContext(ctx context.Context, req MultiFetchRequest) (results FetchResponseChan, err error) {
+	sink := newFetchSink(ctx, c.done)
+	if err = c.roundTrip(ctx, req, &multiFetchResponseJob{
+		fetchSink: sink,
+		mfr:       req,
+	}); err != nil {
 		return nil, err
 	}
 
-	results = resp
+	results = sink.ch
 	return
 }
 
 // We are going to reuse the buffers for fetch and multifetch, so don't keep the slices around
 func (c *SimpleConsumer) Fetch(req FetchRequest) (results FetchResponseChan, err error) {
-	resp := make(FetchResponseChan)
+	return c.FetchContext(context.Background(), req)
+}
 
-	c.responseQueue <- &fetchResponseJob{
-		ch:                   resp,
+// Like Fetch, but gives up once ctx is done.  See MultiFetchContext.
+func (c *SimpleConsumer) FetchContext(ctx context.Context, req FetchRequest) (results FetchResponseChan, err error) {
+	sink := newFetchSink(ctx, c.done)
+	if err = c.roundTrip(ctx, &req, &fetchResponseJob{
+		fetchSink:            sink,
 		TopicPartitionOffset: req.TopicPartitionOffset,
-	}
-
-	if _, err = c.writeRequest(&req); err != nil {
+	}); err != nil {
 		return nil, err
 	}
 
-	results = resp
+	results = sink.ch
 	return
 }
 
 // We are going to reuse the buffers for fetch and multifetch, so don't keep the slices around
 func (c *SimpleConsumer) Offsets(req OffsetsRequest) (results OffsetsResponseChan, err error) {
-	resp := make(OffsetsResponseChan)
-	c.responseQueue <- &offsetsResponseJob{
-		TopicPartition: req.TopicPartition,
-		ch:             resp,
-	}
+	return c.OffsetsContext(context.Background(), req)
+}
 
-	if _, err = c.writeRequest(&req); err != nil {
+// Like Offsets, but gives up once ctx is done.  See MultiFetchContext.
+func (c *SimpleConsumer) OffsetsContext(ctx context.Context, req OffsetsRequest) (results OffsetsResponseChan, err error) {
+	j := newOffsetsResponseJob(ctx, c.done, req.TopicPartition)
+	if err = c.roundTrip(ctx, &req, j); err != nil {
 		return nil, err
 	}
 
-	results = resp
+	results = j.ch
 	return
 }
 
+// Sets the compression used by Produce and MultiProduce for requests whose
+// Compression is CompressionTypeNone.  CompressionTypeForceNone still
+// sends a request uncompressed.
+func (c *SimpleConsumer) SetCompression(compression CompressionType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.compression = compression
+}
+
+// Makes Produce and MultiProduce write every request in the magic 0 format
+// for brokers that don't understand compression attributes
+func (c *SimpleConsumer) SetLegacyFormat(legacy bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.legacyFormat = legacy
+}
+
+func (c *SimpleConsumer) produceDefaults() (CompressionType, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.compression, c.legacyFormat
+}
+
 func (c *SimpleConsumer) MultiProduce(req MultiProduceRequest) (err error) {
-	_, err = c.writeRequest(req)
-	return
+	return c.MultiProduceContext(context.Background(), req)
+}
+
+// Like MultiProduce, but gives up on the write once ctx is done
+func (c *SimpleConsumer) MultiProduceContext(ctx context.Context, req MultiProduceRequest) (err error) {
+	if req, err = req.prepare(c.produceDefaults()); err != nil {
+		return
+	}
+	return c.roundTrip(ctx, req, nil)
 }
 
 func (c *SimpleConsumer) Produce(req *ProduceRequest) (err error) {
-	_, err = c.writeRequest(req)
+	return c.ProduceContext(context.Background(), req)
+}
+
+// Like Produce, but gives up on the write once ctx is done
+func (c *SimpleConsumer) ProduceContext(ctx context.Context, req *ProduceRequest) (err error) {
+	if req, err = req.prepare(c.produceDefaults()); err != nil {
+		return
+	}
+	return c.roundTrip(ctx, req, nil)
+}
+
+// Closes the connection.  Requests still waiting for a response get
+// ErrClosed, as does every later call.
+func (c *SimpleConsumer) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.stop(ErrClosed)
+	return nil
+}
+
+// Records why the consumer stopped and closes the connection, which ends
+// the read worker.  Only the first reason is kept.
+func (c *SimpleConsumer) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+// Returns why the connection stopped, or nil while it's still usable
+func (c *SimpleConsumer) Err() error {
+	return c.stateErr()
+}
+
+// The error new requests fail with, if any
+func (c *SimpleConsumer) stateErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	return c.err
+}
+
+// Queues j for req's response, if req has one, and sends req.  If that
+// fails j is closed since nobody will see its channel.
+func (c *SimpleConsumer) roundTrip(ctx context.Context, req request, j responseJob) (err error) {
+	defer func() {
+		if err != nil && j != nil {
+			j.Close()
+		}
+	}()
+
+	// A request that is cancelled before any of it is sent must leave the
+	// connection alone, so check before every step that can't be undone
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = c.lockWrite(ctx); err != nil {
+		return
+	}
+	defer c.unlockWrite()
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if j != nil {
+		if err = c.enqueue(ctx, j); err != nil {
+			return
+		}
+	}
+
+	if _, err = c.writeRequest(ctx, req); err == nil && j != nil {
+		c.trackResponses(1)
+	}
 	return
 }
 
-func (c *SimpleConsumer) writeRequest(req request) (n int64, err error) {
+func (c *SimpleConsumer) lockWrite(ctx context.Context) error {
+	select {
+	case c.writeLock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.stateErr()
+	}
+}
+
+func (c *SimpleConsumer) unlockWrite() {
+	<-c.writeLock
+}
+
+// Waits for room in the response queue.  Must hold the write lock.
+func (c *SimpleConsumer) enqueue(ctx context.Context, j responseJob) error {
+	c.mu.Lock()
+	if c.err != nil || c.closed {
+		c.mu.Unlock()
+		return c.stateErr()
+	}
+	c.senders.Add(1)
+	c.mu.Unlock()
+
+	defer c.senders.Done()
+
+	select {
+	case c.responseQueue <- j:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return c.stateErr()
+	}
+}
+
+// A time that has passed, to interrupt blocked I/O
+var aLongTimeAgo = time.Unix(1, 0)
+
+// Must hold the write lock.  Once the request starts reaching the
+// connection ctx can interrupt it, which fails the connection since part of
+// the request may be on the wire.  Before that ctx is ignored: the caller
+// has already checked it, and a response job may be queued for the request.
+func (c *SimpleConsumer) writeRequest(ctx context.Context, req request) (n int64, err error) {
+	if err = c.stateErr(); err != nil {
+		return -1, err
+	}
+
+	if c.ioTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.ioTimeout))
+	}
+
+	if ctx.Done() != nil {
+		var stop func() bool
+		interrupted := make(chan struct{})
+		c.startWrite = func() {
+			c.startWrite = nil
+			if ctx.Err() != nil {
+				// Nothing is on the wire, so send it whole
+				return
+			}
+			stop = context.AfterFunc(ctx, func() {
+				c.conn.SetWriteDeadline(aLongTimeAgo)
+				close(interrupted)
+			})
+		}
+		defer func() {
+			c.startWrite = nil
+			if stop != nil && !stop() {
+				<-interrupted
+				// In case it came after the last write
+				c.conn.SetWriteDeadline(time.Time{})
+			}
+
+			if err != nil && ctx.Err() != nil {
+				err = ctx.Err()
+			}
+		}()
+	}
+	if c.ioTimeout > 0 {
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+
 	totalLen := int32(req.Len() + 2) // req, type
 
 	if n, err = binwrite(c.rw, totalLen, req.Type()); err != nil {
-		return -1, err
+		return -1, c.writeFailed(err)
 	}
 
 	var nn int64
 	if nn, err = req.WriteTo(c.rw); err != nil {
-		return -1, err
+		return -1, c.writeFailed(err)
 	}
 	n += nn
 
 	if n != int64(totalLen)+4 {
-		log.Panicln("Did not compute length properly. expected to write", totalLen+4, "but wrote", n)
+		return -1, c.writeFailed(&ProtocolError{
+			Op:     "write " + req.Type().String(),
+			Detail: fmt.Sprintf("computed a length of %d but wrote %d bytes", totalLen+4, n),
+		})
+	}
+	if err = c.rw.Flush(); err != nil {
+		return -1, c.writeFailed(err)
 	}
-	err = c.rw.Flush()
 	return
 }
 
-// This will increment rc's offset
-func (c *SimpleConsumer) readMessagesSet(info TopicPartitionOffset, ch FetchResponseChan, messageStream io.Reader) (err error) {
-	var compression CompressionType
-	var length int32
-	var checksum uint32
-	var magic MagicType
+// Gives the broker a fresh ioTimeout before every read while responses are
+// due.  The time we spend handing messages to a slow caller between reads
+// doesn't count against it.
+func (c *SimpleConsumer) refreshReadDeadline() {
+	if c.ioTimeout <= 0 {
+		return
+	}
 
-	for {
-		switch err = binread(messageStream, &length); err {
-		case nil:
-		case io.EOF:
-			return nil
-		default:
-			return
-		}
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
 
-		payloadLen := length - messageHeaderSize
+	if c.inFlight > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ioTimeout))
+	}
+}
+
+// Sits between rw and the connection to keep the read deadline fresh
+type connReader struct {
+	c *SimpleConsumer
+}
+
+func (r connReader) Read(p []byte) (n int, err error) {
+	r.c.refreshReadDeadline()
+	return r.c.conn.Read(p)
+}
 
-		// TODO: reuse these.  it's not that hard
-		message := make(Message, payloadLen)
+// Sits between rw and the connection so writeRequest knows when a request
+// starts going out
+type connWriter struct {
+	c *SimpleConsumer
+}
+
+func (w connWriter) Write(p []byte) (n int, err error) {
+	if w.c.startWrite != nil {
+		w.c.startWrite()
+	}
+	return w.c.conn.Write(p)
+}
+
+// Counts delta more requests waiting for a response and moves the read
+// deadline to match.  While any are waiting the broker has ioTimeout to send
+// more of them, otherwise we can sit idle as long as we like.  connReader
+// moves the deadline along as the responses come in.
+func (c *SimpleConsumer) trackResponses(delta int) {
+	if c.ioTimeout <= 0 {
+		return
+	}
+
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+
+	c.inFlight += delta
+	if c.inFlight > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ioTimeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
 
-		switch err = binread(messageStream, &magic, &compression, &checksum, message); {
+// Part of a request may have made it onto the wire so the connection can't
+// be used anymore
+func (c *SimpleConsumer) writeFailed(err error) error {
+	c.stop(err)
+	return c.stateErr()
+}
+
+// This will increment rc's offset
+func (c *SimpleConsumer) readMessagesSet(info TopicPartitionOffset, out *fetchSink, messageStream io.Reader) (err error) {
+	return c.readMessages(info, out, messageStream, false)
+}
+
+// Reads messages until the stream is exhausted.  Compressed wrapper messages
+// are decompressed and their inner messages are sent one by one.  Since the
+// broker can only resume from the start of a wrapper, every inner message
+// carries the offset following its wrapper.  If wrapped is set we are reading
+// the inside of a wrapper and the offset is left alone.
+func (c *SimpleConsumer) readMessages(info TopicPartitionOffset, out *fetchSink, messageStream io.Reader, wrapped bool) (err error) {
+	var message Message
+	var compression CompressionType
+	var size int32
+
+	for read := false; ; read = true {
+		message, compression, size, err = readMessage(messageStream)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == io.ErrUnexpectedEOF && !wrapped:
+			// The broker cuts the set off at MaxSize even if that's in the
+			// middle of a message.  The next fetch will pick it up, unless
+			// there was no room for even one message.
+			if !read {
+				out.send(FetchResponse{
+					TopicPartitionOffset: info,
+					Err:                  &FetchSizeError{info, size},
+				})
+			}
+			return nil
 		case err != nil:
 			return err
-		case compression != CompressionTypeNone:
-			return fmt.Errorf("Only support none compression")
-		case magic != MagicTypeWithCompression:
-			return fmt.Errorf("Only support new message format (with magic type of 1)")
-		case crc32.ChecksumIEEE(message) != checksum:
-			return fmt.Errorf("Got invalid checksum")
 		}
 
-		info.Offset += Offset(length + 4)
+		if !wrapped {
+			info.Offset += Offset(size)
+		}
+
+		if compression != CompressionTypeNone {
+			var inner []byte
+			if inner, err = decompressMessages(compression, message); err != nil {
+				return err
+			}
+			if err = c.readMessages(info, out, bytes.NewReader(inner), true); err != nil {
+				return err
+			}
+			continue
+		}
 
 		// If we made it here, we have a valid message
-		ch <- FetchResponse{
+		out.send(FetchResponse{
 			Message:              message,
 			TopicPartitionOffset: info,
+		})
+	}
+}
+
+// Reads a single message in either format.  size is the number of bytes
+// the message takes up including its length and is set as soon as the
+// length has been read.  Returns io.EOF if the stream ends before the
+// message and io.ErrUnexpectedEOF if it ends partway through, in which case
+// the rest of the stream has been discarded.
+func readMessage(messageStream io.Reader) (message Message, compression CompressionType, size int32, err error) {
+	var length int32
+	var checksum uint32
+	var magic MagicType
+
+	if err = binread(messageStream, &length); err != nil {
+		return
+	}
+	size = length + 4
+
+	// Don't allocate for a message that we already know got cut off
+	if n, ok := remaining(messageStream); ok && n < int64(length) {
+		if _, err = io.Copy(ioutil.Discard, messageStream); err == nil {
+			err = io.ErrUnexpectedEOF
 		}
+		return
 	}
 
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+
+	if err = binread(messageStream, &magic); err != nil {
+		return
+	}
+
+	// Magic 0 messages predate the compression attribute
+	var headerSize int32
+	switch magic {
+	case MagicTypeWithoutCompression:
+		headerSize = legacyMessageHeaderSize
+		compression = CompressionTypeNone
+		err = binread(messageStream, &checksum)
+	case MagicTypeWithCompression:
+		headerSize = messageHeaderSize
+		err = binread(messageStream, &compression, &checksum)
+	default:
+		err = &ProtocolError{
+			Op:     "read message",
+			Detail: fmt.Sprintf("unknown magic type %d", magic),
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if length < headerSize {
+		err = &ProtocolError{
+			Op:     "read message",
+			Detail: fmt.Sprintf("length %d is smaller than its header", length),
+		}
+		return
+	}
+
+	// TODO: reuse these.  it's not that hard
+	message = make(Message, length-headerSize)
+
+	switch err = binread(messageStream, message); {
+	case err != nil:
+	case crc32.ChecksumIEEE(message) != checksum:
+		err = fmt.Errorf("Got invalid checksum")
+	}
 	return
 }
 
-// reads stream and processes puts the response into pr's channel
+// How many bytes are left in r, if it can tell
+func remaining(r io.Reader) (n int64, ok bool) {
+	switch r := r.(type) {
+	case *io.LimitedReader:
+		return r.N, true
+	case *bytes.Reader:
+		return int64(r.Len()), true
+	}
+	return 0, false
+}
+
+// Fails every job still waiting for a response.  Must be called after stop
+// so no new jobs can start their way into the queue.
 func (c *SimpleConsumer) failResponses(err error) {
+	go func() {
+		c.senders.Wait()
+		close(c.responseQueue)
+	}()
+
 	for rc := range c.responseQueue {
 		rc.Fail(err)
 	}
@@ -175,21 +590,23 @@ func (c *SimpleConsumer) doRead() (err error) {
 	var responseLength int32
 	var code ErrorCode
 
+	// What's left in the read buffer after a Close mustn't be delivered
+	select {
+	case <-c.done:
+		return c.stateErr()
+	default:
+	}
+
 	if err = binread(c.rw, &responseLength); err != nil {
 		return
 	}
 
-	remainingResponse := io.LimitReader(c.rw, int64(responseLength))
+	remainingResponse := io.LimitReader(c.rw, int64(responseLength)).(*io.LimitedReader)
 
 	if err = binread(remainingResponse, &code); err != nil {
 		return
 	}
 
-	// if the fetch request we sent has an error code, we only fail this one channel
-	if code != ErrorCodeNoError {
-		return code
-	}
-
 	var j responseJob
 
 	// Just to check for error states
@@ -198,24 +615,70 @@ func (c *SimpleConsumer) doRead() (err error) {
 	select {
 	case j = <-c.responseQueue:
 	default:
-		log.Panicln("We received bytes without expecting them")
+		return &ProtocolError{
+			Op:     "read response",
+			Detail: fmt.Sprintf("received %d bytes without a request waiting for them", responseLength),
+		}
+	}
+
+	// if the request we sent has an error code, we only fail this one channel
+	if code != ErrorCodeNoError {
+		j.Fail(code)
+		return discardResponse(remainingResponse)
 	}
 
 	if err = j.ReadResponse(remainingResponse, c); err != nil {
-		j.Fail(err)
-		return
-	} else {
-		j.Close()
+		// A bad response only spoils its own request as long as we can
+		// still find where the next one starts
+		if discardResponse(remainingResponse) == nil {
+			j.Fail(err)
+			return nil
+		}
+		return c.failConnection(j, err)
 	}
-	// Sanity check to make sure we implemented the protocol correctly
-	if remainingResponse.(*io.LimitedReader).N != 0 {
-		log.Panicln(
-			"Did not read eniter message. we have",
-			remainingResponse.(*io.LimitedReader).N,
-			"remaining bytes")
+
+	// Results are dropped once the connection stops, so j has to hear why
+	select {
+	case <-c.done:
+		return c.failConnection(j, c.stateErr())
+	default:
+	}
+
+	// Sanity check to make sure we implemented the protocol correctly.  The
+	// framing is still intact so skip what's left and carry on.
+	if left := remainingResponse.N; left != 0 {
+		if err = discardResponse(remainingResponse); err != nil {
+			return c.failConnection(j, err)
+		}
+		j.Fail(&ProtocolError{
+			Op:     "read response",
+			Detail: fmt.Sprintf("%d bytes were left unread", left),
+		})
+		return nil
 	}
+
+	j.Close()
 	return
+}
+
+// Stops the connection before failing j so j sees the same error as
+// Err.  Closing the connection under us shows up as a read error, in which
+// case j gets ErrClosed.
+func (c *SimpleConsumer) failConnection(j responseJob, err error) error {
+	c.stop(err)
+	j.Fail(c.stateErr())
+	return err
+}
 
+// Skips the rest of a response.  Fails if the connection ends first.
+func discardResponse(r *io.LimitedReader) error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	if r.N != 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
 }
 
 func (c *SimpleConsumer) readWorker() {
@@ -225,7 +688,10 @@ func (c *SimpleConsumer) readWorker() {
 		err := c.doRead()
 		if err != nil {
 			log.Println("Connection closed with error:", err)
+			c.stop(err)
+			c.failResponses(c.stateErr())
 			return
 		}
+		c.trackResponses(-1)
 	}
 }
@@ -1,12 +1,30 @@
 package kafka
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/mikelikespie/go-kafka/kafkatest"
 )
 
+func newTestBroker(t *testing.T) *kafkatest.Broker {
+	b, err := kafkatest.NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
 func TestProduceRequest(t *testing.T) {
-	c, err := Dial("localhost:9092")
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -20,10 +38,6 @@ func TestProduceRequest(t *testing.T) {
 		},
 	}
 
-	if err = c.Produce(req); err != nil {
-		t.Fatal(err)
-	}
-
 	or := OffsetsRequest{
 		TopicPartition: tp,
 		MaxNumber:      1,
@@ -50,6 +64,11 @@ func TestProduceRequest(t *testing.T) {
 		t.Fatal("expected 1 offset, got:", offsets)
 	}
 
+	// Produce after asking for the latest offset so we fetch what we sent
+	if err = c.Produce(req); err != nil {
+		t.Fatal(err)
+	}
+
 	recv := make(chan Message)
 
 	poll := func() {
@@ -62,14 +81,18 @@ func TestProduceRequest(t *testing.T) {
 			fres, err := c.Fetch(fr)
 
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				close(recv)
+				return
 			}
 
 			gotMsg := false
 
 			for msg := range fres {
 				if msg.Err != nil {
-					t.Fatal("Error consuming", msg.Err)
+					t.Error("Error consuming", msg.Err)
+					close(recv)
+					return
 				}
 				t.Log("Got msg", string(msg.Message))
 
@@ -115,7 +138,10 @@ func TestProduceRequest(t *testing.T) {
 }
 
 func TestMultiFetchRequest(t *testing.T) {
-	c, err := Dial("localhost:9092")
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -140,10 +166,6 @@ func TestMultiFetchRequest(t *testing.T) {
 		},
 	}
 
-	if err = c.MultiProduce(req); err != nil {
-		t.Fatal(err)
-	}
-
 	or := OffsetsRequest{
 		TopicPartition: tpfoo,
 		MaxNumber:      1,
@@ -192,6 +214,11 @@ func TestMultiFetchRequest(t *testing.T) {
 		t.Fatal("expected 1 offset, got:", barOffsets)
 	}
 
+	// Produce after asking for the latest offsets so we fetch what we sent
+	if err = c.MultiProduce(req); err != nil {
+		t.Fatal(err)
+	}
+
 	recv := make(chan Message)
 
 	poll := func() {
@@ -210,14 +237,18 @@ func TestMultiFetchRequest(t *testing.T) {
 			fres, err := c.MultiFetch(fr)
 
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				close(recv)
+				return
 			}
 
 			gotMsg := false
 
 			for msg := range fres {
 				if msg.Err != nil {
-					t.Fatal("Error consuming", msg.Err)
+					t.Error("Error consuming", msg.Err)
+					close(recv)
+					return
 				}
 				t.Log("Got msg", string(msg.Message))
 
@@ -259,3 +290,720 @@ func TestMultiFetchRequest(t *testing.T) {
 		t.Fatal("Expected to see 4 messages.  saw", seen)
 	}
 }
+
+func TestReadGZipMessageSet(t *testing.T) {
+	testReadCompressedMessageSet(t, CompressionTypeGZip)
+}
+
+func TestReadSnappyMessageSet(t *testing.T) {
+	testReadCompressedMessageSet(t, CompressionTypeSnappy)
+}
+
+func testReadCompressedMessageSet(t *testing.T, compression CompressionType) {
+	buff := bytes.NewBuffer(nil)
+
+	inner, err := compressMessages(compression, Messages{[]byte("hello"), []byte("there")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapperLen, err := writeMessage(buff, compression, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plainLen, err := Message("plain").WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := TopicPartitionOffset{TopicPartition{"foo", 0}, 100}
+	out := newFetchSink(context.Background(), nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- (&SimpleConsumer{}).readMessagesSet(info, out, buff)
+		out.Close()
+	}()
+
+	var got []FetchResponse
+	for res := range out.ch {
+		got = append(got, res)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 3 {
+		t.Fatal("Expected 3 messages. got", len(got))
+	}
+
+	wrapperEnd := info.Offset + Offset(wrapperLen)
+	expected := []struct {
+		msg    string
+		offset Offset
+	}{
+		{"hello", wrapperEnd},
+		{"there", wrapperEnd},
+		{"plain", wrapperEnd + Offset(plainLen)},
+	}
+
+	for i, e := range expected {
+		if string(got[i].Message) != e.msg || got[i].Offset != e.offset {
+			t.Error("Message", i, "expected", e.msg, "at", e.offset, "got", string(got[i].Message), "at", got[i].Offset)
+		}
+	}
+}
+
+func TestReadLegacyMessageSet(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+
+	legacyLen, err := legacyMessages{[]byte("old")}.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Drop the message set length
+	buff.Next(4)
+	legacyLen -= 4
+
+	currentLen, err := Message("new").WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := TopicPartitionOffset{TopicPartition{"foo", 0}, 0}
+	out := newFetchSink(context.Background(), nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- (&SimpleConsumer{}).readMessagesSet(info, out, buff)
+		out.Close()
+	}()
+
+	var got []FetchResponse
+	for res := range out.ch {
+		got = append(got, res)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 {
+		t.Fatal("Expected 2 messages. got", len(got))
+	}
+
+	if string(got[0].Message) != "old" || got[0].Offset != Offset(legacyLen) {
+		t.Error("Expected old at", legacyLen, "got", string(got[0].Message), "at", got[0].Offset)
+	}
+
+	if string(got[1].Message) != "new" || got[1].Offset != Offset(legacyLen+currentLen) {
+		t.Error("Expected new at", legacyLen+currentLen, "got", string(got[1].Message), "at", got[1].Offset)
+	}
+}
+
+func TestReadPartialMessageSet(t *testing.T) {
+	buff := bytes.NewBuffer(nil)
+
+	firstLen, err := Message("hello").WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Message("there").WriteTo(buff); err != nil {
+		t.Fatal(err)
+	}
+	set := buff.Bytes()
+
+	read := func(set []byte) (got []FetchResponse) {
+		out := newFetchSink(context.Background(), nil)
+		errCh := make(chan error, 1)
+		go func() {
+			r := io.LimitReader(bytes.NewReader(set), int64(len(set)))
+			errCh <- (&SimpleConsumer{}).readMessagesSet(TopicPartitionOffset{}, out, r)
+			out.Close()
+		}()
+
+		for res := range out.ch {
+			got = append(got, res)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// Cut the second message in half
+	got := read(set[:len(set)-3])
+	if len(got) != 1 || string(got[0].Message) != "hello" || got[0].Err != nil {
+		t.Fatal("Expected only the first message. got", got)
+	}
+
+	// Only part of the first message's header
+	got = read(set[:6])
+	if len(got) != 1 {
+		t.Fatal("Expected a single error. got", got)
+	}
+	fse, ok := got[0].Err.(*FetchSizeError)
+	if !ok {
+		t.Fatal("Expected a FetchSizeError. got", got[0].Err)
+	}
+	if fse.MessageSize != int32(firstLen) {
+		t.Error("Expected a message size of", firstLen, "got", fse.MessageSize)
+	}
+}
+
+func TestFetchSizeTooSmall(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello there"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fres, err := c.Fetch(FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetchErr error
+	for res := range fres {
+		fetchErr = res.Err
+	}
+	if _, ok := fetchErr.(*FetchSizeError); !ok {
+		t.Fatal("Expected a FetchSizeError. got", fetchErr)
+	}
+
+	// The connection should still be usable
+	fres, err = c.Fetch(FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-fres
+	if res.Err != nil || string(res.Message) != "hello there" {
+		t.Fatal("Expected hello there. got", res)
+	}
+}
+
+func TestFetchContextTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	delayed := true
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		if delayed {
+			delayed = false
+			return kafkatest.Fault{Delay: 500 * time.Millisecond}
+		}
+		return kafkatest.Fault{}
+	})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	fres, err := c.FetchContext(ctx, fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastErr error
+	for res := range fres {
+		lastErr = res.Err
+	}
+
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Error("Fetch did not give up at its deadline. took", elapsed)
+	}
+	if lastErr != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded. got", lastErr)
+	}
+
+	// The abandoned response still has to be read before this one
+	fres, err = c.Fetch(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-fres
+	if res.Err != nil || string(res.Message) != "hello" {
+		t.Fatal("Expected hello. got", res)
+	}
+}
+
+func TestCancelledContextKeepsConnection(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	b.Produce("foo", 0, []byte("hello"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fr := FetchRequest{TopicPartitionOffset{tp, 0}, 1024}
+	for i := 0; i < 100; i++ {
+		if _, err = c.FetchContext(ctx, fr); err != context.Canceled {
+			t.Fatal("Expected the fetch to be cancelled. got", err)
+		}
+		if _, err = c.MultiFetchContext(ctx, MultiFetchRequest{fr}); err != context.Canceled {
+			t.Fatal("Expected the multifetch to be cancelled. got", err)
+		}
+		if _, err = c.OffsetsContext(ctx, OffsetsRequest{tp, OffsetTimeLatest, 1}); err != context.Canceled {
+			t.Fatal("Expected the offsets request to be cancelled. got", err)
+		}
+		if err = c.ProduceContext(ctx, &ProduceRequest{TopicPartition: tp, Messages: Messages{Message("nope")}}); err != context.Canceled {
+			t.Fatal("Expected the produce to be cancelled. got", err)
+		}
+	}
+
+	if err = c.Err(); err != nil {
+		t.Fatal("Expected the connection to be up. got", err)
+	}
+	if got := fetchAll(t, c, tp); len(got) != 1 || got[0] != "hello" {
+		t.Error("Expected only hello. got", got)
+	}
+}
+
+func TestClose(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		return kafkatest.Fault{Delay: time.Second}
+	})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fr := FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024}
+	pending := make([]FetchResponseChan, 3)
+	for i := range pending {
+		if pending[i], err = c.Fetch(fr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, fres := range pending {
+		res, ok := <-fres
+		if !ok || res.Err != ErrClosed {
+			t.Error("Expected pending fetch", i, "to fail with ErrClosed. got", res.Err)
+		}
+		if _, ok = <-fres; ok {
+			t.Error("Expected pending fetch", i, "to be closed")
+		}
+	}
+
+	if _, err = c.Fetch(fr); err != ErrClosed {
+		t.Error("Expected Fetch after Close to fail with ErrClosed. got", err)
+	}
+
+	if err = c.Produce(&ProduceRequest{TopicPartition: fr.TopicPartition}); err != ErrClosed {
+		t.Error("Expected Produce after Close to fail with ErrClosed. got", err)
+	}
+
+	if err = c.Close(); err != ErrClosed {
+		t.Error("Expected a second Close to fail with ErrClosed. got", err)
+	}
+}
+
+func TestCloseUnreadFetch(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	b.Produce("foo", 0, []byte("hello"), []byte("there"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads the fetch, so the read worker is left holding hello
+	fres, err := c.Fetch(FetchRequest{TopicPartitionOffset{tp, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ores, err := c.Offsets(OffsetsRequest{tp, OffsetTimeLatest, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res, ok := <-ores:
+		if !ok || res.Err != ErrClosed {
+			t.Error("Expected the offsets request to fail with ErrClosed. got", res, ok)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the offsets request to fail")
+	}
+
+	var lastErr error
+	for res := range fres {
+		lastErr = res.Err
+	}
+	if lastErr != ErrClosed {
+		t.Error("Expected the fetch to end with ErrClosed. got", lastErr)
+	}
+}
+
+func TestConnectionDropped(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		return kafkatest.Fault{Drop: true}
+	})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fres, err := c.Offsets(OffsetsRequest{TopicPartition{"foo", 0}, OffsetTimeLatest, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-fres
+	if res.Err == nil {
+		t.Fatal("Expected an error when the connection dropped")
+	}
+
+	// Let the read worker finish shutting down
+	<-c.done
+
+	if _, err = c.Offsets(OffsetsRequest{TopicPartition{"foo", 0}, OffsetTimeLatest, 1}); err == nil {
+		t.Error("Expected requests on a dead connection to fail")
+	}
+}
+
+// Claims to be longer than what it writes
+type lyingRequest struct{}
+
+func (lyingRequest) Len() int32 {
+	return 10
+}
+
+func (lyingRequest) WriteTo(w io.Writer) (int64, error) {
+	return binwrite(w, int16(0))
+}
+
+func (lyingRequest) Type() requestType {
+	return requestTypeFetch
+}
+
+func TestWriteLengthMismatch(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := newSimpleConsumer(client)
+	defer c.Close()
+
+	err := c.roundTrip(context.Background(), lyingRequest{}, nil)
+	if _, ok := err.(*ProtocolError); !ok {
+		t.Fatal("Expected a ProtocolError. got", err)
+	}
+
+	if _, ok := c.Err().(*ProtocolError); !ok {
+		t.Error("Expected the consumer to stop with a ProtocolError. got", c.Err())
+	}
+}
+
+func TestUnexpectedResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	c := newSimpleConsumer(client)
+	defer c.Close()
+
+	// A response of just an error code when we never asked for anything
+	if _, err := server.Write([]byte{0, 0, 0, 2, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.done:
+	case <-time.After(time.Second):
+		t.Fatal("Consumer did not stop")
+	}
+
+	if _, ok := c.Err().(*ProtocolError); !ok {
+		t.Error("Expected the consumer to stop with a ProtocolError. got", c.Err())
+	}
+}
+
+func TestErrorCodeKeepsConnection(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	failed := true
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		if req.Type == kafkatest.RequestTypeOffsets && failed {
+			failed = false
+			return kafkatest.Fault{ErrorCode: kafkatest.ErrorCodeUnknown}
+		}
+		return kafkatest.Fault{}
+	})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tp := TopicPartition{"foo", 0}
+
+	// Pipeline a failing offsets request, an out of range fetch and a good one
+	offsets, err := c.Offsets(OffsetsRequest{tp, OffsetTimeLatest, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outOfRange, err := c.Fetch(FetchRequest{TopicPartitionOffset{tp, 1000}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, err := c.Fetch(FetchRequest{TopicPartitionOffset{tp, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-offsets; res.Err != ErrorCodeUnknown {
+		t.Error("Expected ErrorCodeUnknown. got", res.Err)
+	}
+
+	if res := <-outOfRange; res.Err != ErrorCodeOffsetOutOfRange {
+		t.Error("Expected ErrorCodeOffsetOutOfRange. got", res.Err)
+	}
+
+	if res := <-good; res.Err != nil || string(res.Message) != "hello" {
+		t.Error("Expected hello. got", res)
+	}
+
+	if c.Err() != nil {
+		t.Error("Connection should still be up. got", c.Err())
+	}
+}
+
+func TestMultiFetchPartitionError(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fres, err := c.MultiFetch(MultiFetchRequest{
+		FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 1000}, 1024},
+		FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []FetchResponse
+	for res := range fres {
+		got = append(got, res)
+	}
+
+	if len(got) != 2 {
+		t.Fatal("Expected 2 responses. got", got)
+	}
+
+	if got[0].Err != ErrorCodeOffsetOutOfRange || got[0].Offset != 1000 {
+		t.Error("Expected ErrorCodeOffsetOutOfRange at 1000. got", got[0])
+	}
+
+	if got[1].Err != nil || string(got[1].Message) != "hello" {
+		t.Error("Expected hello. got", got[1])
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	const workers = 8
+	const rounds = 50
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Every worker has its own topic so any mixed up response shows
+	topic := func(w int) string {
+		return fmt.Sprint("topic-", w)
+	}
+	for w := 0; w < workers; w++ {
+		b.Produce(topic(w), 0, []byte(topic(w)))
+	}
+
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			tp := TopicPartition{topic(w), 0}
+			for i := 0; i < rounds; i++ {
+				if err := c.Produce(&ProduceRequest{TopicPartition: TopicPartition{topic(w), 1}, Messages: Messages{Message(topic(w))}}); err != nil {
+					errs <- err
+					return
+				}
+
+				fres, err := c.Fetch(FetchRequest{TopicPartitionOffset{tp, 0}, 1024})
+				if err != nil {
+					errs <- err
+					return
+				}
+				offsets, err := c.Offsets(OffsetsRequest{tp, OffsetTimeEarliest, 1})
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				for res := range fres {
+					if res.Err != nil || string(res.Message) != topic(w) || res.Topic != topic(w) {
+						errs <- fmt.Errorf("worker %d got the wrong fetch response %v", w, res)
+						return
+					}
+				}
+				for res := range offsets {
+					if res.Err != nil || len(res.Offsets) != 1 || res.Offsets[0].Topic != topic(w) {
+						errs <- fmt.Errorf("worker %d got the wrong offsets response %v", w, res)
+						return
+					}
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	for w := 0; w < workers; w++ {
+		if _, data := b.Log(topic(w), 1); len(data) != rounds*(len(topic(w))+messageFullHeaderSize) {
+			t.Error("Expected", rounds, "produced messages for", topic(w), "got", len(data), "bytes")
+		}
+	}
+}
+
+func TestConcurrentCancelledRequests(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	const workers = 4
+	const rounds = 50
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tp := TopicPartition{"foo", 0}
+	b.Produce("foo", 0, []byte("hello"))
+	fr := FetchRequest{TopicPartitionOffset{tp, 0}, 1024}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Some workers only ever cancel, before sending or while waiting for
+	// the response.  Neither may spoil the connection for the others.
+	errs := make(chan error, 3*workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < rounds; i++ {
+				if _, err := c.FetchContext(cancelled, fr); err != context.Canceled {
+					errs <- fmt.Errorf("expected the fetch to be cancelled. got %v", err)
+					return
+				}
+				if err := c.ProduceContext(cancelled, &ProduceRequest{TopicPartition: tp, Messages: Messages{Message("nope")}}); err != context.Canceled {
+					errs <- fmt.Errorf("expected the produce to be cancelled. got %v", err)
+					return
+				}
+			}
+			errs <- nil
+		}()
+
+		go func() {
+			for i := 0; i < rounds; i++ {
+				ctx, cancel := context.WithCancel(context.Background())
+				fres, err := c.FetchContext(ctx, fr)
+				cancel()
+				if err != nil {
+					errs <- err
+					return
+				}
+				for range fres {
+				}
+			}
+			errs <- nil
+		}()
+
+		go func() {
+			for i := 0; i < rounds; i++ {
+				fres, err := c.Fetch(fr)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for res := range fres {
+					if res.Err != nil || string(res.Message) != "hello" {
+						errs <- fmt.Errorf("expected hello. got %v", res)
+						return
+					}
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	for i := 0; i < 3*workers; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if err = c.Err(); err != nil {
+		t.Error("Expected the connection to be up. got", err)
+	}
+	if _, data := b.Log("foo", 0); len(data) != len("hello")+messageFullHeaderSize {
+		t.Error("Expected no cancelled produce to reach the broker. got", len(data), "bytes")
+	}
+}
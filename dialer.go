@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Options for connecting to a broker.  The zero value dials plain TCP with
+// no timeouts, same as Dial.
+type Dialer struct {
+	// Network to dial, "tcp" if empty.  Anything net.Dial takes works, e.g.
+	// "unix".
+	Network string
+
+	// How long connecting, including the TLS handshake, may take.  0 means
+	// no limit beyond the context's.
+	Timeout time.Duration
+
+	// How long writing a request or waiting for its response may take
+	// before the connection is given up on.  0 means no limit.
+	IOTimeout time.Duration
+
+	// TCP keepalive period, see net.Dialer.  Unused with a custom
+	// DialFunc.
+	KeepAlive time.Duration
+
+	// Speak TLS over the connection if set.  ServerName defaults to the
+	// host in addr.
+	TLSConfig *tls.Config
+
+	// Sizes of the buffers between us and the connection.  0 uses bufio's
+	// defaults.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// Makes the underlying connection instead of a net.Dialer, say to go
+	// through a proxy
+	DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (d *Dialer) Dial(addr string) (c *SimpleConsumer, err error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// Like Dial, but gives up once ctx is done.  ctx only covers connecting.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (c *SimpleConsumer, err error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	network := d.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	var conn net.Conn
+	if d.DialFunc != nil {
+		conn, err = d.DialFunc(ctx, network, addr)
+	} else {
+		nd := net.Dialer{KeepAlive: d.KeepAlive}
+		conn, err = nd.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.TLSConfig != nil {
+		if conn, err = d.handshake(ctx, conn, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.newSimpleConsumer(conn), nil
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, addr string) (tlsConn *tls.Conn, err error) {
+	config := d.TLSConfig
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	tlsConn = tls.Client(conn, config)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return
+}
+
+// Like DialReconnecting, with every connection made by d
+func (d *Dialer) DialReconnecting(addr string, backoff Backoff) (*ReconnectingConsumer, error) {
+	return newReconnectingConsumer(context.Background(), func(ctx context.Context) (*SimpleConsumer, error) {
+		return d.DialContext(ctx, addr)
+	}, backoff)
+}
+
+func (d *Dialer) newSimpleConsumer(conn net.Conn) (c *SimpleConsumer) {
+	c = &SimpleConsumer{
+		conn:          conn,
+		responseQueue: make(chan responseJob, defaultQueueSize),
+		writeLock:     make(chan struct{}, 1),
+		ioTimeout:     d.IOTimeout,
+		done:          make(chan struct{}),
+	}
+
+	r := bufio.NewReader(connReader{c})
+	if d.ReadBufferSize > 0 {
+		r = bufio.NewReaderSize(connReader{c}, d.ReadBufferSize)
+	}
+	w := bufio.NewWriter(connWriter{c})
+	if d.WriteBufferSize > 0 {
+		w = bufio.NewWriterSize(connWriter{c}, d.WriteBufferSize)
+	}
+	c.rw = bufio.NewReadWriter(r, w)
+
+	go c.readWorker()
+
+	return c
+}
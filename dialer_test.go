@@ -0,0 +1,199 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/kafkatest"
+)
+
+func fetchAll(t *testing.T, c *SimpleConsumer, tp TopicPartition) (got []string) {
+	fres, err := c.Fetch(FetchRequest{TopicPartitionOffset{tp, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for res := range fres {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		got = append(got, string(res.Message))
+	}
+	return
+}
+
+func TestDialerIOTimeout(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	d := Dialer{IOTimeout: 50 * time.Millisecond}
+	c, err := d.Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Sitting idle for longer than the timeout is fine
+	time.Sleep(100 * time.Millisecond)
+	if got := fetchAll(t, c, TopicPartition{"foo", 0}); len(got) != 1 {
+		t.Fatal("Expected 1 message. got", got)
+	}
+
+	// A slow broker isn't
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		return kafkatest.Fault{Delay: time.Second}
+	})
+
+	fres, err := c.Fetch(FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-fres
+	if ne, ok := res.Err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("Expected a timeout. got", res.Err)
+	}
+	if c.Err() != res.Err {
+		t.Error("Expected the connection to be stopped by", res.Err, "got", c.Err())
+	}
+}
+
+func TestDialerIOTimeoutSlowReader(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	// Far more than fits in the read buffer
+	const n = 20
+	for i := 0; i < n; i++ {
+		b.Produce("foo", 0, bytes.Repeat([]byte("x"), 1024))
+	}
+
+	d := Dialer{IOTimeout: 50 * time.Millisecond}
+	c, err := d.Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fres, err := c.Fetch(FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Taking far longer than the timeout to read it all is our business
+	got := 0
+	for res := range fres {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		got++
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got != n {
+		t.Error("Expected", n, "messages. got", got)
+	}
+	if err = c.Err(); err != nil {
+		t.Error("Expected the connection to be up. got", err)
+	}
+}
+
+func TestDialerDialFunc(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	var dialed string
+	d := Dialer{
+		Network: "kafka",
+		DialFunc: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = network + " " + addr
+			var nd net.Dialer
+			return nd.DialContext(ctx, "tcp", b.Addr)
+		},
+	}
+
+	c, err := d.Dial("somewhere")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if dialed != "kafka somewhere" {
+		t.Error("Expected DialFunc to get the network and address. got", dialed)
+	}
+	if got := fetchAll(t, c, TopicPartition{"foo", 0}); len(got) != 1 {
+		t.Error("Expected 1 message. got", got)
+	}
+}
+
+func TestDialerTLS(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	// Borrow httptest's certificate for a TLS terminator in front of the broker
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", b.Addr)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.Close()
+			}()
+			go func() {
+				io.Copy(conn, upstream)
+				conn.Close()
+			}()
+		}
+	}()
+
+	d := Dialer{
+		Timeout:   time.Second,
+		TLSConfig: ts.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+
+	// The certificate covers 127.0.0.1, which ServerName defaults to
+	wrong := d
+	wrong.TLSConfig = d.TLSConfig.Clone()
+	wrong.TLSConfig.ServerName = "kafka.invalid"
+	if _, err = wrong.Dial(l.Addr().String()); err == nil {
+		t.Fatal("Expected the handshake to fail for the wrong server name")
+	}
+
+	c, err := d.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if got := fetchAll(t, c, TopicPartition{"foo", 0}); len(got) != 1 {
+		t.Error("Expected 1 message. got", got)
+	}
+}
@@ -0,0 +1,296 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mikelikespie/go-kafka/zk"
+)
+
+const (
+	brokerIdsPath    = "/brokers/ids"
+	brokerTopicsPath = "/brokers/topics"
+)
+
+// A broker as registered under /brokers/ids
+type BrokerInfo struct {
+	ID   int32
+	Addr string
+}
+
+// One broker's share of a topic.  In 0.7 every broker numbers its own
+// partitions of a topic from 0, so a partition is only unique together
+// with its broker.
+type TopicBroker struct {
+	BrokerInfo
+	Partitions int32
+}
+
+// Sent by WatchTopic.  After an Err the channel is closed.
+type TopicUpdate struct {
+	Brokers []TopicBroker
+	Err     error
+}
+
+// Reads the brokers and topics a Kafka 0.7 cluster registers in ZooKeeper
+type Discovery struct {
+	zk *zk.Conn
+}
+
+func NewDiscovery(conn *zk.Conn) *Discovery {
+	return &Discovery{conn}
+}
+
+// Registered brokers, by ID
+func (d *Discovery) Brokers() (brokers []BrokerInfo, err error) {
+	brokers, _, err = d.brokers(false)
+	return
+}
+
+// Names of the topics any broker has registered
+func (d *Discovery) Topics() (topics []string, err error) {
+	topics, err = d.zk.Children(brokerTopicsPath)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	sort.Strings(topics)
+	return
+}
+
+// Brokers that have registered topic, by ID, and how many partitions each
+// has.  Empty if no broker has the topic yet.
+func (d *Discovery) Topic(topic string) (brokers []TopicBroker, err error) {
+	brokers, _, err = d.topic(topic, false)
+	return
+}
+
+// Every partition of topics, by the address of the broker it's on.  Suits
+// NewMultiBrokerStreamWithOffsets.
+func (d *Discovery) Partitions(topics ...string) (targets map[string][]TopicPartition, err error) {
+	targets = make(map[string][]TopicPartition)
+	for _, topic := range topics {
+		brokers, err := d.Topic(topic)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range brokers {
+			for p := Partition(0); p < Partition(b.Partitions); p++ {
+				targets[b.Addr] = append(targets[b.Addr], TopicPartition{topic, p})
+			}
+		}
+	}
+	return targets, nil
+}
+
+// Sends topic's brokers now and again whenever they change, until ctx is
+// done or ZooKeeper can't be read.
+func (d *Discovery) WatchTopic(ctx context.Context, topic string) <-chan TopicUpdate {
+	out := make(chan TopicUpdate)
+	go func() {
+		defer close(out)
+
+		for {
+			brokers, events, err := d.topic(topic, true)
+
+			select {
+			case out <- TopicUpdate{brokers, err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+
+			if err = waitForChange(ctx, d.zk, events); err != nil {
+				if ctx.Err() == nil {
+					select {
+					case out <- TopicUpdate{Err: err}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// Waits for the first of events.  Returns an error if that one means we
+// stopped watching, or ctx's error.  The rest of events are unwatched since
+// the next wait will watch everything again.
+func waitForChange(ctx context.Context, conn *zk.Conn, events []<-chan zk.Event) error {
+	changed := make(chan zk.Event, len(events))
+	stop := make(chan struct{})
+	defer close(stop)
+	defer conn.Unwatch(events...)
+
+	for _, ch := range events {
+		go func(ch <-chan zk.Event) {
+			select {
+			case ev := <-ch:
+				changed <- ev
+			case <-stop:
+			}
+		}(ch)
+	}
+
+	select {
+	case ev := <-changed:
+		if ev.Type == zk.EventNotWatching {
+			return ev.Err
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Discovery) brokers(watch bool) (brokers []BrokerInfo, events []<-chan zk.Event, err error) {
+	var ids []string
+	if watch {
+		var ch <-chan zk.Event
+		ids, ch, err = d.zk.ChildrenW(brokerIdsPath)
+		if err == nil {
+			events = append(events, ch)
+		}
+	} else {
+		ids, err = d.zk.Children(brokerIdsPath)
+	}
+	switch err {
+	case nil:
+	case zk.ErrNoNode:
+		// No broker has ever started
+		if !watch {
+			return nil, nil, nil
+		}
+		events, err = d.watchCreate(brokerIdsPath)
+		return nil, events, err
+	default:
+		return nil, nil, err
+	}
+
+	for _, name := range ids {
+		id, err := strconv.ParseInt(name, 10, 32)
+		if err != nil {
+			d.zk.Unwatch(events...)
+			return nil, nil, fmt.Errorf("Bad broker id %q in %s", name, brokerIdsPath)
+		}
+
+		data, _, err := d.zk.Get(brokerIdsPath + "/" + name)
+		if err == zk.ErrNoNode {
+			// Went away since we listed them
+			continue
+		} else if err != nil {
+			d.zk.Unwatch(events...)
+			return nil, nil, err
+		}
+
+		// creator:host:port, where the creator is just informational
+		info := string(data)
+		i := strings.Index(info, ":")
+		if i < 0 {
+			d.zk.Unwatch(events...)
+			return nil, nil, fmt.Errorf("Bad registration %q for broker %d", info, id)
+		}
+		brokers = append(brokers, BrokerInfo{int32(id), info[i+1:]})
+	}
+
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i].ID < brokers[j].ID })
+	return
+}
+
+func (d *Discovery) topic(topic string, watch bool) (brokers []TopicBroker, events []<-chan zk.Event, err error) {
+	registered, events, err := d.brokers(watch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path := brokerTopicsPath + "/" + topic
+
+	var ids []string
+	if watch {
+		var ch <-chan zk.Event
+		ids, ch, err = d.zk.ChildrenW(path)
+		if err == nil {
+			events = append(events, ch)
+		}
+	} else {
+		ids, err = d.zk.Children(path)
+	}
+	switch err {
+	case nil:
+	case zk.ErrNoNode:
+		if !watch {
+			return nil, nil, nil
+		}
+		var created []<-chan zk.Event
+		if created, err = d.watchCreate(path); err != nil {
+			d.zk.Unwatch(events...)
+			return nil, nil, err
+		}
+		return nil, append(events, created...), nil
+	default:
+		d.zk.Unwatch(events...)
+		return nil, nil, err
+	}
+
+	live := make(map[string]BrokerInfo, len(registered))
+	for _, b := range registered {
+		live[strconv.Itoa(int(b.ID))] = b
+	}
+
+	for _, name := range ids {
+		b, ok := live[name]
+		if !ok {
+			// Registered the topic but isn't up
+			continue
+		}
+
+		var data []byte
+		if watch {
+			var ch <-chan zk.Event
+			data, _, ch, err = d.zk.GetW(path + "/" + name)
+			if err == nil {
+				events = append(events, ch)
+			}
+		} else {
+			data, _, err = d.zk.Get(path + "/" + name)
+		}
+		if err == zk.ErrNoNode {
+			// Went away since we listed them
+			err = nil
+			continue
+		} else if err != nil {
+			d.zk.Unwatch(events...)
+			return nil, nil, err
+		}
+
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 32)
+		if err != nil {
+			d.zk.Unwatch(events...)
+			return nil, nil, fmt.Errorf("Bad partition count %q for topic %s on broker %d", data, topic, b.ID)
+		}
+		brokers = append(brokers, TopicBroker{b, int32(n)})
+	}
+
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i].ID < brokers[j].ID })
+	return brokers, events, nil
+}
+
+// Watches for path to be created.  If it already was since we looked, the
+// returned channel fires right away.
+func (d *Discovery) watchCreate(path string) (events []<-chan zk.Event, err error) {
+	ok, _, ch, err := d.zk.ExistsW(path)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		created := make(chan zk.Event, 1)
+		created <- zk.Event{Type: zk.EventNodeCreated, Path: path}
+		return []<-chan zk.Event{created, ch}, nil
+	}
+	return []<-chan zk.Event{ch}, nil
+}
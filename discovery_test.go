@@ -0,0 +1,168 @@
+package kafka
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/zk"
+	"github.com/mikelikespie/go-kafka/zk/zktest"
+)
+
+func newTestDiscovery(t *testing.T) (*zktest.Server, *Discovery, func()) {
+	s, err := zktest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := zk.Dial(s.Addr, time.Second)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+
+	return s, NewDiscovery(conn), func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestDiscoveryTopic(t *testing.T) {
+	s, d, done := newTestDiscovery(t)
+	defer done()
+
+	s.Set("/brokers/ids/0", []byte("10.0.0.1-1300000000000:10.0.0.1:9092"))
+	s.Set("/brokers/ids/1", []byte("10.0.0.2-1300000000000:10.0.0.2:9092"))
+	s.Set("/brokers/topics/foo/0", []byte("4"))
+	s.Set("/brokers/topics/foo/1", []byte("2"))
+	// Broker 2 registered bar once but isn't up
+	s.Set("/brokers/topics/bar/2", []byte("1"))
+
+	brokers, err := d.Brokers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []BrokerInfo{{0, "10.0.0.1:9092"}, {1, "10.0.0.2:9092"}}
+	if !reflect.DeepEqual(brokers, expected) {
+		t.Error("Expected", expected, "got", brokers)
+	}
+
+	topics, err := d.Topics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(topics, []string{"bar", "foo"}) {
+		t.Error("Expected bar and foo. got", topics)
+	}
+
+	foo, err := d.Topic("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedFoo := []TopicBroker{{expected[0], 4}, {expected[1], 2}}
+	if !reflect.DeepEqual(foo, expectedFoo) {
+		t.Error("Expected", expectedFoo, "got", foo)
+	}
+
+	targets, err := d.Partitions("foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedTargets := map[string][]TopicPartition{
+		"10.0.0.1:9092": {{"foo", 0}, {"foo", 1}, {"foo", 2}, {"foo", 3}},
+		"10.0.0.2:9092": {{"foo", 0}, {"foo", 1}},
+	}
+	if !reflect.DeepEqual(targets, expectedTargets) {
+		t.Error("Expected", expectedTargets, "got", targets)
+	}
+
+	for _, topic := range []string{"bar", "nope"} {
+		if brokers, err := d.Topic(topic); err != nil || len(brokers) != 0 {
+			t.Error("Expected no brokers for", topic, "got", brokers, err)
+		}
+	}
+}
+
+func TestDiscoveryWatchTopic(t *testing.T) {
+	s, d, done := newTestDiscovery(t)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := d.WatchTopic(ctx, "foo")
+	next := func() []TopicBroker {
+		select {
+		case u := <-updates:
+			if u.Err != nil {
+				t.Fatal(u.Err)
+			}
+			return u.Brokers
+		case <-time.After(time.Second):
+			t.Fatal("Expected an update")
+			return nil
+		}
+	}
+
+	if brokers := next(); len(brokers) != 0 {
+		t.Fatal("Expected no brokers yet. got", brokers)
+	}
+
+	s.Set("/brokers/ids/0", []byte("creator:localhost:9092"))
+	if brokers := next(); len(brokers) != 0 {
+		t.Fatal("Expected no brokers with foo yet. got", brokers)
+	}
+
+	s.Set("/brokers/topics/foo/0", []byte("1"))
+	brokers := next()
+	for len(brokers) == 0 {
+		// The parent and the child show up as separate changes
+		brokers = next()
+	}
+	if len(brokers) != 1 || brokers[0].Partitions != 1 {
+		t.Fatal("Expected broker 0 with 1 partition. got", brokers)
+	}
+
+	s.Set("/brokers/topics/foo/0", []byte("3"))
+	if brokers = next(); len(brokers) != 1 || brokers[0].Partitions != 3 {
+		t.Fatal("Expected broker 0 with 3 partitions. got", brokers)
+	}
+
+	// Only what the last look at the topic watched is left
+	for i := 0; i < 10; i++ {
+		s.Set("/brokers/topics/foo/0", []byte("3"))
+		next()
+	}
+	if n := d.zk.Watches(); n > 3 {
+		t.Error("Expected at most 3 watches. got", n)
+	}
+
+	s.Delete("/brokers/ids/0")
+	if brokers = next(); len(brokers) != 0 {
+		t.Fatal("Expected broker 0 to be gone. got", brokers)
+	}
+
+	cancel()
+	for range updates {
+	}
+}
+
+func TestDiscoveryWatchTopicError(t *testing.T) {
+	s, d, done := newTestDiscovery(t)
+	defer done()
+
+	s.Set("/brokers/ids/0", []byte("creator:localhost:9092"))
+	s.Set("/brokers/ids/1", []byte("creator:localhost:9093"))
+	s.Set("/brokers/topics/foo/0", []byte("1"))
+	s.Set("/brokers/topics/foo/1", []byte("lots"))
+
+	if _, _, err := d.topic("foo", true); err == nil {
+		t.Fatal("Expected an error for the bad partition count")
+	}
+
+	// Nobody will wait on what was watched before the error
+	if n := d.zk.Watches(); n != 0 {
+		t.Error("Expected no watches. got", n)
+	}
+}
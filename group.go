@@ -0,0 +1,684 @@
+package kafka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/zk"
+)
+
+const consumersPath = "/consumers"
+
+// A partition in a 0.7 cluster, where partitions are numbered per broker
+type BrokerPartition struct {
+	BrokerID int32
+	TopicPartition
+}
+
+// How the partition is named under a group's owners and offsets
+func (bp BrokerPartition) name() string {
+	return fmt.Sprintf("%d-%d", bp.BrokerID, bp.Partition)
+}
+
+// A message or error from a GroupConsumer along with the broker it came from
+type GroupMessage struct {
+	BrokerID int32
+	FetchResponse
+}
+
+type GroupConfig struct {
+	Group  string
+	Topics []string
+
+	// Unique name of this member.  Defaults to hostname-millis-random like
+	// the JVM client.
+	ConsumerID string
+
+	// Used for every broker connection
+	Dialer Dialer
+
+	// Largest fetch per partition, grown when a message doesn't fit.
+	// defaultFetchSize if 0.
+	FetchSize int32
+	// How long to wait between fetches.  pollTime if 0.
+	PollInterval time.Duration
+	// How often to write offsets to ZooKeeper.  10 seconds if 0.
+	CommitInterval time.Duration
+	// Where to start partitions the group has no offset for yet.
+	// OffsetTimeLatest if 0.
+	StartTime OffsetTime
+	// How long to wait before trying again when a partition we were
+	// assigned is still owned by its last consumer.  1 second if 0.
+	RebalanceBackoff time.Duration
+}
+
+const (
+	defaultCommitInterval   = 10 * time.Second
+	defaultRebalanceBackoff = time.Second
+)
+
+// Consumes topics as one member of a group.  Members register under
+// /consumers/<group>/ids, split the partitions between them with the 0.7
+// range strategy, claim them under /consumers/<group>/owners and keep their
+// offsets under /consumers/<group>/offsets.  Whenever a member or broker
+// comes or goes the partitions are split again.
+//
+// Messages are delivered on Messages.  A message counts as consumed, and is
+// committed with the next Commit, once it has been received.  If ZooKeeper
+// can't be read the last value carries the error and the channel is closed.
+type GroupConsumer struct {
+	zk        *zk.Conn
+	discovery *Discovery
+	config    GroupConfig
+	id        string
+
+	Messages <-chan GroupMessage
+	out      chan GroupMessage
+
+	mu        sync.Mutex
+	owned     []BrokerPartition
+	offsets   map[BrokerPartition]Offset
+	committed map[BrokerPartition]Offset
+	conns     map[int32]*ReconnectingConsumer
+	err       error
+
+	// Held while writing offsets so a slow periodic commit can't overwrite
+	// a newer one
+	commitLock sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Joins config.Group using conn, which stays open after Close.  Consuming
+// starts once the first rebalance is done.
+func NewGroupConsumer(conn *zk.Conn, config GroupConfig) (g *GroupConsumer, err error) {
+	if config.FetchSize <= 0 {
+		config.FetchSize = defaultFetchSize
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = pollTime
+	}
+	if config.CommitInterval <= 0 {
+		config.CommitInterval = defaultCommitInterval
+	}
+	if config.StartTime == 0 {
+		config.StartTime = OffsetTimeLatest
+	}
+	if config.RebalanceBackoff <= 0 {
+		config.RebalanceBackoff = defaultRebalanceBackoff
+	}
+	if config.ConsumerID == "" {
+		if config.ConsumerID, err = defaultConsumerID(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make(chan GroupMessage)
+	g = &GroupConsumer{
+		zk:        conn,
+		discovery: NewDiscovery(conn),
+		config:    config,
+		id:        config.ConsumerID,
+		Messages:  out,
+		out:       out,
+		offsets:   make(map[BrokerPartition]Offset),
+		committed: make(map[BrokerPartition]Offset),
+		conns:     make(map[int32]*ReconnectingConsumer),
+		done:      make(chan struct{}),
+	}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+
+	if err = g.register(); err != nil {
+		return nil, err
+	}
+
+	go g.run()
+	go g.commitLoop()
+
+	return g, nil
+}
+
+func defaultConsumerID() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	var random [4]byte
+	if _, err = rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", host, time.Now().UnixMilli(), hex.EncodeToString(random[:])), nil
+}
+
+func (g *GroupConsumer) path(parts ...string) string {
+	p := consumersPath + "/" + g.config.Group
+	for _, part := range parts {
+		p += "/" + part
+	}
+	return p
+}
+
+// Our one thread, in the JVM client's terms
+func (g *GroupConsumer) threadID() string {
+	return g.id + "-0"
+}
+
+// Adds us to the group's members along with the topics we want
+func (g *GroupConsumer) register() error {
+	if err := g.zk.CreateAll(g.path("ids")); err != nil {
+		return err
+	}
+
+	counts := make(map[string]int, len(g.config.Topics))
+	for _, topic := range g.config.Topics {
+		counts[topic] = 1
+	}
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+
+	_, err = g.zk.Create(g.path("ids", g.id), data, zk.FlagEphemeral)
+	return err
+}
+
+// Partitions currently assigned to us
+func (g *GroupConsumer) Assignment() []BrokerPartition {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]BrokerPartition(nil), g.owned...)
+}
+
+// Why we stopped, if it wasn't Close
+func (g *GroupConsumer) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.err
+}
+
+// Leaves the group after committing the offsets of everything received.
+// Returns the error that stopped us, if any.
+func (g *GroupConsumer) Close() error {
+	g.cancel()
+	<-g.done
+	return g.Err()
+}
+
+func (g *GroupConsumer) fail(err error) {
+	if g.ctx.Err() != nil {
+		// Whatever it was, it's because we're closing
+		return
+	}
+
+	g.mu.Lock()
+	g.err = err
+	g.mu.Unlock()
+
+	log.Println("Group consumer stopping:", err)
+	select {
+	case g.out <- GroupMessage{FetchResponse: FetchResponse{Err: err}}:
+	case <-g.ctx.Done():
+	}
+}
+
+func (g *GroupConsumer) run() {
+	stopFetching := func() {}
+	defer func() {
+		stopFetching()
+		if err := g.Commit(); err != nil {
+			log.Println("Final commit failed:", err)
+		}
+		g.release()
+		g.zk.Delete(g.path("ids", g.id), zk.AnyVersion)
+
+		g.mu.Lock()
+		for _, c := range g.conns {
+			c.Close()
+		}
+		g.mu.Unlock()
+
+		close(g.out)
+		close(g.done)
+	}()
+
+	for {
+		assignment, addrs, events, err := g.assignment()
+		if err != nil {
+			g.fail(err)
+			return
+		}
+
+		if !sameAssignment(assignment, g.Assignment()) {
+			stopFetching()
+			stopFetching = func() {}
+			if err = g.Commit(); err != nil {
+				log.Println("Commit before rebalancing failed:", err)
+			}
+			g.release()
+
+			if err = g.claim(assignment); err == zk.ErrNodeExists {
+				// The last owner hasn't let go yet.  Look at everything
+				// again in a bit since it may have changed too.
+				log.Println("Partition still owned, retrying rebalance")
+				g.release()
+				g.zk.Unwatch(events...)
+				select {
+				case <-time.After(g.config.RebalanceBackoff):
+					continue
+				case <-g.ctx.Done():
+					return
+				}
+			} else if err != nil {
+				g.fail(err)
+				return
+			}
+
+			if err = g.loadOffsets(assignment, addrs); err != nil {
+				g.fail(err)
+				return
+			}
+			stopFetching = g.startFetching(assignment)
+		}
+
+		if err = waitForChange(g.ctx, g.zk, events); err != nil {
+			if g.ctx.Err() == nil {
+				g.fail(err)
+			}
+			return
+		}
+	}
+}
+
+func sameAssignment(a, b []BrokerPartition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Works out which partitions are ours, watching everything it depends on
+func (g *GroupConsumer) assignment() (mine []BrokerPartition, addrs map[int32]string, events []<-chan zk.Event, err error) {
+	members, ch, err := g.zk.ChildrenW(g.path("ids"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	events = append(events, ch)
+
+	subscriptions := make(map[string]map[string]int, len(members))
+	for _, member := range members {
+		data, _, err := g.zk.Get(g.path("ids", member))
+		if err == zk.ErrNoNode {
+			// Left since we listed them
+			continue
+		} else if err != nil {
+			g.zk.Unwatch(events...)
+			return nil, nil, nil, err
+		}
+
+		var counts map[string]int
+		if err = json.Unmarshal(data, &counts); err != nil {
+			log.Printf("Ignoring member %s with subscription %q: %v", member, data, err)
+			continue
+		}
+		subscriptions[member] = counts
+	}
+
+	addrs = make(map[int32]string)
+	for _, topic := range g.config.Topics {
+		brokers, topicEvents, err := g.discovery.topic(topic, true)
+		if err != nil {
+			g.zk.Unwatch(events...)
+			return nil, nil, nil, err
+		}
+		events = append(events, topicEvents...)
+
+		var partitions []BrokerPartition
+		for _, b := range brokers {
+			addrs[b.ID] = b.Addr
+			for p := int32(0); p < b.Partitions; p++ {
+				partitions = append(partitions, BrokerPartition{b.ID, TopicPartition{topic, Partition(p)}})
+			}
+		}
+
+		var threads []string
+		for member, counts := range subscriptions {
+			for i := 0; i < counts[topic]; i++ {
+				threads = append(threads, fmt.Sprintf("%s-%d", member, i))
+			}
+		}
+
+		mine = append(mine, rangeAssign(partitions, threads, g.threadID())...)
+	}
+	return mine, addrs, events, nil
+}
+
+// The 0.7 range strategy.  Partitions and threads are both sorted by name
+// and each thread gets a contiguous run of partitions, the first few
+// threads getting one extra if they don't divide evenly.
+func rangeAssign(partitions []BrokerPartition, threads []string, thread string) []BrokerPartition {
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i].name() < partitions[j].name() })
+	sort.Strings(threads)
+
+	i := sort.SearchStrings(threads, thread)
+	if i == len(threads) || threads[i] != thread {
+		return nil
+	}
+
+	per, extra := len(partitions)/len(threads), len(partitions)%len(threads)
+	start := per*i + min(i, extra)
+	n := per
+	if i < extra {
+		n++
+	}
+	return partitions[start : start+n]
+}
+
+func (g *GroupConsumer) ownerPath(bp BrokerPartition) string {
+	return g.path("owners", bp.Topic, bp.name())
+}
+
+func (g *GroupConsumer) offsetPath(bp BrokerPartition) string {
+	return g.path("offsets", bp.Topic, bp.name())
+}
+
+// Takes ownership of every partition in assignment or none of them
+func (g *GroupConsumer) claim(assignment []BrokerPartition) error {
+	for _, bp := range assignment {
+		if err := g.zk.CreateAll(g.path("owners", bp.Topic)); err != nil {
+			return err
+		}
+		if _, err := g.zk.Create(g.ownerPath(bp), []byte(g.threadID()), zk.FlagEphemeral); err != nil {
+			return err
+		}
+
+		g.mu.Lock()
+		g.owned = append(g.owned, bp)
+		g.mu.Unlock()
+	}
+	return nil
+}
+
+// Gives up every partition we own
+func (g *GroupConsumer) release() {
+	g.mu.Lock()
+	owned := g.owned
+	g.owned = nil
+	for _, bp := range owned {
+		delete(g.offsets, bp)
+		delete(g.committed, bp)
+	}
+	g.mu.Unlock()
+
+	for _, bp := range owned {
+		if err := g.zk.Delete(g.ownerPath(bp), zk.AnyVersion); err != nil && err != zk.ErrNoNode {
+			log.Println("Couldn't release", bp.name(), "of", bp.Topic, ":", err)
+		}
+	}
+}
+
+// Where each partition in assignment picks up: the group's committed
+// offset, or StartTime if there isn't one
+func (g *GroupConsumer) loadOffsets(assignment []BrokerPartition, addrs map[int32]string) error {
+	for _, bp := range assignment {
+		c, err := g.conn(bp.BrokerID, addrs[bp.BrokerID])
+		if err != nil {
+			return err
+		}
+
+		data, _, err := g.zk.Get(g.offsetPath(bp))
+		if err == nil {
+			n, err := strconv.ParseInt(string(data), 10, 64)
+			if err != nil {
+				return fmt.Errorf("Bad offset %q for %s of %s", data, bp.name(), bp.Topic)
+			}
+			g.mu.Lock()
+			g.offsets[bp] = Offset(n)
+			g.committed[bp] = Offset(n)
+			g.mu.Unlock()
+			continue
+		} else if err != zk.ErrNoNode {
+			return err
+		}
+
+		ch, err := c.OffsetsContext(g.ctx, OffsetsRequest{bp.TopicPartition, g.config.StartTime, 1})
+		if err != nil {
+			return err
+		}
+		res := <-ch
+		if res.Err != nil {
+			return res.Err
+		}
+		if len(res.Offsets) == 0 {
+			return fmt.Errorf("No offsets for %s of %s", bp.name(), bp.Topic)
+		}
+
+		g.mu.Lock()
+		g.offsets[bp] = res.Offsets[0].Offset
+		g.mu.Unlock()
+	}
+	return nil
+}
+
+func (g *GroupConsumer) conn(brokerID int32, addr string) (c *ReconnectingConsumer, err error) {
+	g.mu.Lock()
+	c = g.conns[brokerID]
+	g.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+
+	if c, err = g.config.Dialer.DialReconnecting(addr, Backoff{}); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	g.conns[brokerID] = c
+	g.mu.Unlock()
+	return c, nil
+}
+
+// Starts a fetcher per broker in assignment.  The returned func stops them
+// and waits for them to finish.
+func (g *GroupConsumer) startFetching(assignment []BrokerPartition) (stop func()) {
+	byBroker := make(map[int32][]BrokerPartition)
+	for _, bp := range assignment {
+		byBroker[bp.BrokerID] = append(byBroker[bp.BrokerID], bp)
+	}
+
+	ctx, cancel := context.WithCancel(g.ctx)
+	var wg sync.WaitGroup
+	for brokerID, partitions := range byBroker {
+		g.mu.Lock()
+		c := g.conns[brokerID]
+		g.mu.Unlock()
+
+		wg.Add(1)
+		go func(brokerID int32, partitions []BrokerPartition) {
+			defer wg.Done()
+			g.fetch(ctx, c, brokerID, partitions)
+		}(brokerID, partitions)
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func (g *GroupConsumer) fetch(ctx context.Context, c *ReconnectingConsumer, brokerID int32, partitions []BrokerPartition) {
+	fetchSizes := make(map[TopicPartition]int32)
+
+	for len(partitions) > 0 {
+		a := time.After(g.config.PollInterval)
+
+		mfr := make(MultiFetchRequest, len(partitions))
+		g.mu.Lock()
+		for i, bp := range partitions {
+			size, ok := fetchSizes[bp.TopicPartition]
+			if !ok {
+				size = g.config.FetchSize
+			}
+			mfr[i] = FetchRequest{TopicPartitionOffset{bp.TopicPartition, g.offsets[bp]}, size}
+		}
+		g.mu.Unlock()
+
+		ch, err := c.MultiFetchContext(ctx, mfr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if !g.deliver(ctx, GroupMessage{brokerID, FetchResponse{Err: err}}) {
+				return
+			}
+
+			// Try again after the poll interval
+			select {
+			case <-a:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for res := range ch {
+			if fse, ok := res.Err.(*FetchSizeError); ok {
+				size, ok := fetchSizes[fse.TopicPartition]
+				if !ok {
+					size = g.config.FetchSize
+				}
+				fetchSizes[fse.TopicPartition] = max(fse.MessageSize, size*2)
+				continue
+			}
+
+			bp := BrokerPartition{brokerID, res.TopicPartition}
+			if res.Err != nil {
+				if !g.deliver(ctx, GroupMessage{brokerID, res}) {
+					for range ch {
+					}
+					return
+				}
+
+				// Stop fetching a partition that failed until the next
+				// rebalance
+				for i := range partitions {
+					if partitions[i] == bp {
+						partitions = append(partitions[:i:i], partitions[i+1:]...)
+						break
+					}
+				}
+				continue
+			}
+
+			// The message that needed a bigger fetch has arrived
+			delete(fetchSizes, res.TopicPartition)
+
+			// Moved first so a Commit right after the receive includes it
+			g.mu.Lock()
+			prev := g.offsets[bp]
+			g.offsets[bp] = res.Offset
+			g.mu.Unlock()
+
+			if !g.deliver(ctx, GroupMessage{brokerID, res}) {
+				g.mu.Lock()
+				g.offsets[bp] = prev
+				g.mu.Unlock()
+
+				for range ch {
+				}
+				return
+			}
+		}
+
+		select {
+		case <-a:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns false if ctx was done first
+func (g *GroupConsumer) deliver(ctx context.Context, m GroupMessage) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case g.out <- m:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (g *GroupConsumer) commitLoop() {
+	t := time.NewTicker(g.config.CommitInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-g.done:
+			return
+		}
+		if err := g.Commit(); err != nil {
+			log.Println("Commit failed:", err)
+		}
+	}
+}
+
+// Writes the offset after the last message received from each partition
+// we own to ZooKeeper
+func (g *GroupConsumer) Commit() error {
+	g.commitLock.Lock()
+	defer g.commitLock.Unlock()
+
+	g.mu.Lock()
+	dirty := make(map[BrokerPartition]Offset)
+	for bp, offset := range g.offsets {
+		if committed, ok := g.committed[bp]; !ok || committed != offset {
+			dirty[bp] = offset
+		}
+	}
+	g.mu.Unlock()
+
+	for bp, offset := range dirty {
+		path := g.offsetPath(bp)
+		data := []byte(strconv.FormatInt(int64(offset), 10))
+
+		_, err := g.zk.Set(path, data, zk.AnyVersion)
+		if err == zk.ErrNoNode {
+			if err = g.zk.CreateAll(g.path("offsets", bp.Topic)); err != nil {
+				return err
+			}
+			_, err = g.zk.Create(path, data, 0)
+		}
+		if err != nil {
+			return err
+		}
+
+		g.mu.Lock()
+		if _, ok := g.offsets[bp]; ok {
+			g.committed[bp] = offset
+		}
+		g.mu.Unlock()
+	}
+	return nil
+}
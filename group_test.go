@@ -0,0 +1,228 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/kafkatest"
+	"github.com/mikelikespie/go-kafka/zk"
+	"github.com/mikelikespie/go-kafka/zk/zktest"
+)
+
+func TestRangeAssign(t *testing.T) {
+	var partitions []BrokerPartition
+	for _, broker := range []int32{0, 1} {
+		for p := Partition(0); p < 3; p++ {
+			partitions = append(partitions, BrokerPartition{broker, TopicPartition{"foo", p}})
+		}
+	}
+	threads := []string{"c-0", "a-0", "b-0", "d-0"}
+
+	// 6 partitions over 4 threads: the first two threads get an extra one
+	expected := map[string][]string{
+		"a-0": {"0-0", "0-1"},
+		"b-0": {"0-2", "1-0"},
+		"c-0": {"1-1"},
+		"d-0": {"1-2"},
+	}
+	for thread, names := range expected {
+		var got []string
+		for _, bp := range rangeAssign(partitions, threads, thread) {
+			got = append(got, bp.name())
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Error("Thread", thread, "expected", names, "got", got)
+		}
+	}
+
+	if got := rangeAssign(partitions, threads, "e-0"); len(got) != 0 {
+		t.Error("Expected nothing for a thread that isn't subscribed. got", got)
+	}
+}
+
+// A broker with 4 partitions of foo, registered in a ZooKeeper
+func newTestCluster(t *testing.T) (*kafkatest.Broker, *zktest.Server) {
+	b := newTestBroker(t)
+	b.CreateTopic("foo", 4)
+
+	s, err := zktest.NewServer()
+	if err != nil {
+		b.Close()
+		t.Fatal(err)
+	}
+	s.Set("/brokers/ids/0", []byte("creator:"+b.Addr))
+	s.Set("/brokers/topics/foo/0", []byte("4"))
+	return b, s
+}
+
+func newTestGroupConsumer(t *testing.T, s *zktest.Server, id string) *GroupConsumer {
+	conn, err := zk.Dial(s.Addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := NewGroupConsumer(conn, GroupConfig{
+		Group:            "group",
+		Topics:           []string{"foo"},
+		ConsumerID:       id,
+		PollInterval:     10 * time.Millisecond,
+		CommitInterval:   time.Hour,
+		StartTime:        OffsetTimeEarliest,
+		RebalanceBackoff: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func waitForAssignment(t *testing.T, g *GroupConsumer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(g.Assignment()) != n {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected", n, "partitions. got", g.Assignment())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGroupConsumer(t *testing.T) {
+	b, s := newTestCluster(t)
+	defer b.Close()
+	defer s.Close()
+
+	var ends []int64
+	for p := int32(0); p < 4; p++ {
+		ends = append(ends, b.Produce("foo", p, []byte(fmt.Sprint("message ", p))))
+	}
+
+	g := newTestGroupConsumer(t, s, "a")
+	waitForAssignment(t, g, 4)
+
+	got := make(map[Partition]string)
+	for len(got) < 4 {
+		select {
+		case m := <-g.Messages:
+			if m.Err != nil {
+				t.Fatal(m.Err)
+			}
+			if m.BrokerID != 0 {
+				t.Error("Expected broker 0. got", m.BrokerID)
+			}
+			got[m.Partition] = string(m.Message)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected 4 messages. got", got)
+		}
+	}
+	for p := Partition(0); p < 4; p++ {
+		if got[p] != fmt.Sprint("message ", p) {
+			t.Error("Partition", p, "expected its message. got", got[p])
+		}
+	}
+
+	if err := g.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for p := range 4 {
+		path := fmt.Sprintf("/consumers/group/offsets/foo/0-%d", p)
+		if data, _ := s.Get(path); string(data) != fmt.Sprint(ends[p]) {
+			t.Error("Expected", path, "to be", ends[p], "got", string(data))
+		}
+		if owner, _ := s.Get(fmt.Sprintf("/consumers/group/owners/foo/0-%d", p)); string(owner) != "a-0" {
+			t.Error("Expected a-0 to own partition", p, "got", string(owner))
+		}
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("/consumers/group/ids/a"); ok {
+		t.Error("Expected a to leave the group")
+	}
+	if _, ok := s.Get("/consumers/group/owners/foo/0-0"); ok {
+		t.Error("Expected a to give up its partitions")
+	}
+	if _, ok := <-g.Messages; ok {
+		t.Error("Expected Messages to be closed")
+	}
+}
+
+func TestGroupConsumerRebalance(t *testing.T) {
+	b, s := newTestCluster(t)
+	defer b.Close()
+	defer s.Close()
+
+	a := newTestGroupConsumer(t, s, "a")
+	defer a.Close()
+	waitForAssignment(t, a, 4)
+
+	c := newTestGroupConsumer(t, s, "c")
+	waitForAssignment(t, a, 2)
+	waitForAssignment(t, c, 2)
+
+	expected := []BrokerPartition{{0, TopicPartition{"foo", 2}}, {0, TopicPartition{"foo", 3}}}
+	if got := c.Assignment(); !reflect.DeepEqual(got, expected) {
+		t.Error("Expected c to get the last two partitions. got", got)
+	}
+
+	// c picks up where the group left off
+	end := b.Produce("foo", 3, []byte("hello"))
+	select {
+	case m := <-c.Messages:
+		if m.Err != nil || string(m.Message) != "hello" || m.Offset != Offset(end) {
+			t.Error("Expected hello. got", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected c to get a message")
+	}
+
+	c.Close()
+	waitForAssignment(t, a, 4)
+}
+
+func TestGroupFetchError(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	// Every fetch on a closed connection fails straight away
+	c, err := DialReconnecting(b.Addr, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	out := make(chan GroupMessage)
+	g := &GroupConsumer{
+		config:  GroupConfig{FetchSize: defaultFetchSize, PollInterval: 5 * time.Millisecond},
+		out:     out,
+		offsets: make(map[BrokerPartition]Offset),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.fetch(ctx, c, 0, []BrokerPartition{{0, TopicPartition{"foo", 0}}})
+	}()
+
+	for range 2 {
+		select {
+		case m := <-out:
+			if m.Err != ErrClosed {
+				t.Error("Expected ErrClosed. got", m.Err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the fetch to keep retrying")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the fetcher to stop once cancelled")
+	}
+}
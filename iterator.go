@@ -0,0 +1,117 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+)
+
+// Returned by FetchIterator.Next once there are no more results
+var ErrIteratorDone = errors.New("No more fetch results")
+
+// Pulls the results of a fetch, multifetch or stream one at a time, with
+// errors returned apart from messages.
+//
+// A result left unread holds up the connection it came from, so call
+// Close if you stop before Next returns ErrIteratorDone.
+type FetchIterator struct {
+	ch    <-chan FetchResponse
+	close func()
+	once  sync.Once
+	done  bool
+}
+
+func newFetchIterator(ch <-chan FetchResponse, close func()) *FetchIterator {
+	return &FetchIterator{ch: ch, close: close}
+}
+
+// Cancels the request ch is for, so the rest of its response is skipped
+// rather than read out message by message, and drains whatever is left of
+// ch in the background
+func drain(ch <-chan FetchResponse, cancel context.CancelFunc) func() {
+	return func() {
+		cancel()
+		go func() {
+			for range ch {
+			}
+		}()
+	}
+}
+
+// Like FetchContext, but as an iterator.  Closing the iterator cancels the
+// fetch.
+func (c *SimpleConsumer) FetchIter(ctx context.Context, req FetchRequest) (it *FetchIterator, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := c.FetchContext(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newFetchIterator(ch, drain(ch, cancel)), nil
+}
+
+// Like MultiFetchContext, but as an iterator.  An error only fails its own
+// partition, so Next can return messages after one.  Closing the iterator
+// cancels the multifetch.
+func (c *SimpleConsumer) MultiFetchIter(ctx context.Context, req MultiFetchRequest) (it *FetchIterator, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch, err := c.MultiFetchContext(ctx, req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newFetchIterator(ch, drain(ch, cancel)), nil
+}
+
+// Reads Ch as an iterator.  Closing the iterator closes the stream.
+func (s *KafkaStream) Iter() *FetchIterator {
+	return newFetchIterator(s.Ch, func() { s.Close() })
+}
+
+// Waits for the next result.  A message comes back with a nil error.  An
+// error comes back with the topic, partition and offset it was for, if it
+// was for one.  Returns ErrIteratorDone after the last result, or ctx's
+// error if it's done first, in which case Next can be called again.
+func (it *FetchIterator) Next(ctx context.Context) (res FetchResponse, err error) {
+	if it.done {
+		return FetchResponse{}, ErrIteratorDone
+	}
+	if err = ctx.Err(); err != nil {
+		return FetchResponse{}, err
+	}
+
+	select {
+	case res, ok := <-it.ch:
+		if !ok {
+			it.done = true
+			return FetchResponse{}, ErrIteratorDone
+		}
+		return res, res.Err
+	case <-ctx.Done():
+		return FetchResponse{}, ctx.Err()
+	}
+}
+
+// Every result until the last one or until ctx is done, whose error is
+// the last thing yielded.  The iterator is closed when the loop ends.
+func (it *FetchIterator) All(ctx context.Context) iter.Seq2[FetchResponse, error] {
+	return func(yield func(FetchResponse, error) bool) {
+		defer it.Close()
+
+		for {
+			res, err := it.Next(ctx)
+			if err == ErrIteratorDone || !yield(res, err) {
+				return
+			}
+			if err != nil && err == ctx.Err() {
+				return
+			}
+		}
+	}
+}
+
+// Gives up on the remaining results.  Safe to call more than once.
+func (it *FetchIterator) Close() {
+	it.once.Do(it.close)
+}
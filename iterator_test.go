@@ -0,0 +1,234 @@
+package kafka
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/kafkatest"
+)
+
+func TestFetchIter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"), []byte("there"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	it, err := c.FetchIter(ctx, FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"hello", "there"} {
+		res, err := it.Next(ctx)
+		if err != nil || string(res.Message) != expected {
+			t.Fatal("Expected", expected, "got", res, err)
+		}
+	}
+	for range 2 {
+		if _, err = it.Next(ctx); err != ErrIteratorDone {
+			t.Error("Expected ErrIteratorDone. got", err)
+		}
+	}
+}
+
+func TestMultiFetchIter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	it, err := c.MultiFetchIter(ctx, MultiFetchRequest{
+		FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 1000}, 1024},
+		FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	var errs []error
+	for res, err := range it.All(ctx) {
+		if err != nil {
+			if res.Offset != 1000 {
+				t.Error("Expected the error for offset 1000. got", res)
+			}
+			errs = append(errs, err)
+			continue
+		}
+		messages = append(messages, string(res.Message))
+	}
+
+	if !reflect.DeepEqual(errs, []error{ErrorCodeOffsetOutOfRange}) {
+		t.Error("Expected ErrorCodeOffsetOutOfRange. got", errs)
+	}
+	if !reflect.DeepEqual(messages, []string{"hello"}) {
+		t.Error("Expected hello. got", messages)
+	}
+}
+
+func TestFetchIterBreak(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	b.Produce("foo", 0, []byte("a"), []byte("b"), []byte("c"))
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	it, err := c.FetchIter(context.Background(), FetchRequest{TopicPartitionOffset{tp, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range it.All(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+
+	// What we didn't read mustn't hold up the connection
+	if got := fetchAll(t, c, tp); len(got) != 3 {
+		t.Error("Expected 3 messages. got", got)
+	}
+}
+
+func TestFetchIterCloseCancels(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	b.Produce("foo", 0, []byte("hello"))
+
+	delayed := true
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		if delayed {
+			delayed = false
+			return kafkatest.Fault{Delay: time.Second}
+		}
+		return kafkatest.Fault{}
+	})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	it, err := c.FetchIter(context.Background(), FetchRequest{TopicPartitionOffset{tp, 0}, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.Close()
+
+	// Closing gave up on the fetch without waiting for its response
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case _, ok := <-it.ch:
+			if ok {
+				continue
+			}
+		case <-timeout:
+			t.Fatal("Expected the fetch to be cancelled")
+		}
+		break
+	}
+
+	if got := fetchAll(t, c, tp); len(got) != 1 || got[0] != "hello" {
+		t.Error("Expected only hello. got", got)
+	}
+}
+
+func TestFetchIterContext(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{TopicPartition{"foo", 0}, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it := s.Iter()
+
+	// Nothing to read, so only the context ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err = it.Next(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded. got", err)
+	}
+
+	var errs []error
+	for _, err := range it.All(ctx) {
+		errs = append(errs, err)
+	}
+	if !reflect.DeepEqual(errs, []error{context.DeadlineExceeded}) {
+		t.Error("Expected only DeadlineExceeded. got", errs)
+	}
+
+	// Ending the loop closed the stream
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected the stream to be closed")
+	}
+}
+
+func TestStreamIter(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tp := TopicPartition{"foo", 0}
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{tp, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Produce("foo", 0, []byte("hello"), []byte("there"))
+
+	var got []string
+	for res, err := range s.Iter().All(context.Background()) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got = append(got, string(res.Message)); len(got) == 2 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(got, []string{"hello", "there"}) {
+		t.Error("Expected hello there. got", got)
+	}
+
+	if _, ok := <-s.Ch; ok {
+		t.Error("Expected the stream to be closed")
+	}
+}
@@ -0,0 +1,609 @@
+// Package kafkatest provides an in-memory Kafka 0.7 broker for tests.
+//
+// The broker listens on a loopback address and speaks the produce, fetch,
+// multifetch, multiproduce and offsets requests.  Logs live in memory and
+// offsets are byte positions, like the real thing.  Faults can be injected
+// per request to exercise client error handling.
+//
+// It deliberately doesn't import the kafka package so the kafka package's
+// own tests can use it.
+package kafkatest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var networkOrder = binary.BigEndian
+
+type RequestType int16
+
+const (
+	RequestTypeProduce      RequestType = 0
+	RequestTypeFetch        RequestType = 1
+	RequestTypeMultiFetch   RequestType = 2
+	RequestTypeMultiProduce RequestType = 3
+	RequestTypeOffsets      RequestType = 4
+)
+
+// Error codes as they go on the wire
+const (
+	ErrorCodeUnknown          int16 = -1
+	ErrorCodeNoError          int16 = 0
+	ErrorCodeOffsetOutOfRange int16 = 1
+	ErrorCodeInvalidMessage   int16 = 2
+	ErrorCodeWrongPartition   int16 = 3
+	ErrorCodeInvalidFetchSize int16 = 4
+)
+
+const (
+	offsetTimeLatest   int64 = -1
+	offsetTimeEarliest int64 = -2
+)
+
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+// What a FaultFunc gets to look at
+type Request struct {
+	Type RequestType
+
+	// Every topic and partition the request touches, in request order
+	Targets []TopicPartition
+	// For fetches, the MaxSize of each target
+	FetchSizes []int32
+}
+
+// Describes how to misbehave when answering a request.  The zero value
+// answers normally.
+type Fault struct {
+	// Wait this long before handling the request
+	Delay time.Duration
+
+	// Close the connection instead of handling the request
+	Drop bool
+
+	// Answer with only this error code instead of the real response.
+	// Produce requests have no response so they are discarded instead.
+	ErrorCode int16
+
+	// Write only the first Truncate bytes of the response (including its
+	// length prefix) and then close the connection
+	Truncate int
+	// With Truncate, wait this long before closing the connection, as a
+	// broker that hangs partway through a response would
+	Stall time.Duration
+}
+
+// Decides the fault for each request the broker receives
+type FaultFunc func(req Request) Fault
+
+type partitionLog struct {
+	// Offset of the first byte in data.  Moves up when the log is truncated
+	base int64
+	data []byte
+}
+
+func (l *partitionLog) end() int64 {
+	return l.base + int64(len(l.data))
+}
+
+type Broker struct {
+	// Address the broker is listening on
+	Addr string
+
+	ln net.Listener
+
+	mu         sync.Mutex
+	logs       map[TopicPartition]*partitionLog
+	partitions map[string]int32
+	fault      FaultFunc
+	conns      map[net.Conn]bool
+	accepted   int
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Starts a broker on a random loopback port
+func NewBroker() (*Broker, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Broker{
+		Addr:       ln.Addr().String(),
+		ln:         ln,
+		logs:       make(map[TopicPartition]*partitionLog),
+		partitions: make(map[string]int32),
+		conns:      make(map[net.Conn]bool),
+		done:       make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.acceptLoop()
+
+	return b, nil
+}
+
+// Stops listening, drops every connection and waits for them to finish
+func (b *Broker) Close() error {
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+
+	close(b.done)
+	err := b.ln.Close()
+	b.DropConnections()
+	b.wg.Wait()
+	return err
+}
+
+// Closes every open client connection.  The broker keeps listening.
+func (b *Broker) DropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// Number of connections accepted so far
+func (b *Broker) Accepted() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.accepted
+}
+
+// Installs f to decide the fault for every following request.  nil turns
+// fault injection off.
+func (b *Broker) SetFault(f FaultFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.fault = f
+}
+
+// Limits topic to the given number of partitions.  Requests for partitions
+// outside of it fail with ErrorCodeWrongPartition.  Topics that were never
+// created accept any partition.
+func (b *Broker) CreateTopic(topic string, partitions int32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.partitions[topic] = partitions
+}
+
+// Appends an encoded message set to a partition's log and returns the new
+// end offset
+func (b *Broker) Append(topic string, partition int32, messageSet []byte) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := b.log(TopicPartition{topic, partition})
+	l.data = append(l.data, messageSet...)
+	return l.end()
+}
+
+// Appends each payload as an uncompressed message and returns the new end
+// offset
+func (b *Broker) Produce(topic string, partition int32, payloads ...[]byte) int64 {
+	return b.Append(topic, partition, EncodeMessages(payloads...))
+}
+
+// Drops everything in the log before offset, as retention would
+func (b *Broker) Truncate(topic string, partition int32, offset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := b.log(TopicPartition{topic, partition})
+	if offset <= l.base {
+		return
+	}
+	if offset > l.end() {
+		offset = l.end()
+	}
+	l.data = l.data[offset-l.base:]
+	l.base = offset
+}
+
+// Returns a copy of the bytes in a partition's log and the offset they start at
+func (b *Broker) Log(topic string, partition int32) (base int64, data []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	l := b.log(TopicPartition{topic, partition})
+	return l.base, append([]byte(nil), l.data...)
+}
+
+// Encodes payloads as uncompressed magic 1 messages
+func EncodeMessages(payloads ...[]byte) []byte {
+	var set []byte
+	for _, p := range payloads {
+		var header [10]byte
+		networkOrder.PutUint32(header[0:], uint32(6+len(p)))
+		header[4] = 1 // magic
+		header[5] = 0 // no compression
+		networkOrder.PutUint32(header[6:], crc32.ChecksumIEEE(p))
+		set = append(set, header[:]...)
+		set = append(set, p...)
+	}
+	return set
+}
+
+// Must hold mu
+func (b *Broker) log(tp TopicPartition) *partitionLog {
+	l := b.logs[tp]
+	if l == nil {
+		l = &partitionLog{}
+		b.logs[tp] = l
+	}
+	return l
+}
+
+// Must hold mu
+func (b *Broker) validPartition(tp TopicPartition) bool {
+	n, ok := b.partitions[tp.Topic]
+	return tp.Partition >= 0 && (!ok || tp.Partition < n)
+}
+
+func (b *Broker) acceptLoop() {
+	defer b.wg.Done()
+
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		select {
+		case <-b.done:
+			b.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		b.conns[conn] = true
+		b.accepted++
+		b.mu.Unlock()
+
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		var size int32
+		if err := binary.Read(r, networkOrder, &size); err != nil || size < 2 {
+			return
+		}
+
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		d := &decoder{b: body}
+		typ := RequestType(d.int16())
+		req, err := parseRequest(typ, d)
+		if err != nil {
+			return
+		}
+
+		b.mu.Lock()
+		faultFunc := b.fault
+		b.mu.Unlock()
+
+		var fault Fault
+		if faultFunc != nil {
+			fault = faultFunc(req.Request)
+		}
+
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-b.done:
+				return
+			}
+		}
+
+		if fault.Drop {
+			return
+		}
+
+		var resp []byte
+		if fault.ErrorCode != ErrorCodeNoError {
+			if req.Type == RequestTypeProduce || req.Type == RequestTypeMultiProduce {
+				continue
+			}
+			resp = appendInt16(nil, fault.ErrorCode)
+		} else {
+			resp = b.handle(req)
+		}
+
+		// Produce requests don't get answered
+		if resp == nil {
+			continue
+		}
+
+		framed := appendInt32(nil, int32(len(resp)))
+		framed = append(framed, resp...)
+		if fault.Truncate > 0 && fault.Truncate < len(framed) {
+			conn.Write(framed[:fault.Truncate])
+			select {
+			case <-time.After(fault.Stall):
+			case <-b.done:
+			}
+			return
+		}
+
+		if _, err := conn.Write(framed); err != nil {
+			return
+		}
+	}
+}
+
+// A decoded request along with the parts of it we need to answer it
+type parsedRequest struct {
+	Request
+
+	produces []produce
+	fetches  []fetch
+	offsets  offsetsQuery
+}
+
+type produce struct {
+	TopicPartition
+	messageSet []byte
+}
+
+type fetch struct {
+	TopicPartition
+	offset  int64
+	maxSize int32
+}
+
+type offsetsQuery struct {
+	TopicPartition
+	time      int64
+	maxNumber int32
+}
+
+func parseRequest(typ RequestType, d *decoder) (req *parsedRequest, err error) {
+	req = &parsedRequest{Request: Request{Type: typ}}
+
+	switch typ {
+	case RequestTypeProduce:
+		req.produces = []produce{d.produce()}
+	case RequestTypeMultiProduce:
+		req.produces = make([]produce, d.int16())
+		for i := range req.produces {
+			req.produces[i] = d.produce()
+		}
+	case RequestTypeFetch:
+		req.fetches = []fetch{d.fetch()}
+	case RequestTypeMultiFetch:
+		req.fetches = make([]fetch, d.int16())
+		for i := range req.fetches {
+			req.fetches[i] = d.fetch()
+		}
+	case RequestTypeOffsets:
+		req.offsets = offsetsQuery{d.topicPartition(), d.int64(), d.int32()}
+		req.Targets = append(req.Targets, req.offsets.TopicPartition)
+	default:
+		return nil, fmt.Errorf("kafkatest: unknown request type %d", typ)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if len(d.b) != 0 {
+		return nil, fmt.Errorf("kafkatest: %d trailing bytes in request of type %d", len(d.b), typ)
+	}
+
+	for _, p := range req.produces {
+		req.Targets = append(req.Targets, p.TopicPartition)
+	}
+	for _, f := range req.fetches {
+		req.Targets = append(req.Targets, f.TopicPartition)
+		req.FetchSizes = append(req.FetchSizes, f.maxSize)
+	}
+
+	return req, nil
+}
+
+// Builds the response body (everything after the length).  nil for requests
+// that don't get a response
+func (b *Broker) handle(req *parsedRequest) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch req.Type {
+	case RequestTypeProduce, RequestTypeMultiProduce:
+		for _, p := range req.produces {
+			if b.validPartition(p.TopicPartition) && validMessageSet(p.messageSet) {
+				l := b.log(p.TopicPartition)
+				l.data = append(l.data, p.messageSet...)
+			}
+		}
+		return nil
+
+	case RequestTypeFetch:
+		code, data := b.fetch(req.fetches[0])
+		return append(appendInt16(nil, code), data...)
+
+	case RequestTypeMultiFetch:
+		resp := appendInt16(nil, ErrorCodeNoError)
+		for _, f := range req.fetches {
+			code, data := b.fetch(f)
+			resp = appendInt32(resp, int32(2+len(data)))
+			resp = appendInt16(resp, code)
+			resp = append(resp, data...)
+		}
+		return resp
+
+	case RequestTypeOffsets:
+		code, offsets := b.offsets(req.offsets)
+		resp := appendInt16(nil, code)
+		resp = appendInt32(resp, int32(len(offsets)))
+		for _, o := range offsets {
+			resp = appendInt64(resp, o)
+		}
+		return resp
+	}
+
+	return nil
+}
+
+// Must hold mu
+func (b *Broker) fetch(f fetch) (code int16, data []byte) {
+	if !b.validPartition(f.TopicPartition) {
+		return ErrorCodeWrongPartition, nil
+	}
+	if f.maxSize < 0 {
+		return ErrorCodeInvalidFetchSize, nil
+	}
+
+	l := b.log(f.TopicPartition)
+	if f.offset < l.base || f.offset > l.end() {
+		return ErrorCodeOffsetOutOfRange, nil
+	}
+
+	// Like the real broker we just hand back bytes, even if the last
+	// message gets cut in half
+	start := f.offset - l.base
+	end := start + int64(f.maxSize)
+	if end > int64(len(l.data)) {
+		end = int64(len(l.data))
+	}
+	return ErrorCodeNoError, l.data[start:end]
+}
+
+// Must hold mu
+func (b *Broker) offsets(q offsetsQuery) (code int16, offsets []int64) {
+	if !b.validPartition(q.TopicPartition) {
+		return ErrorCodeWrongPartition, nil
+	}
+
+	l := b.log(q.TopicPartition)
+	switch q.time {
+	case offsetTimeLatest:
+		offsets = []int64{l.end()}
+	case offsetTimeEarliest:
+		offsets = []int64{l.base}
+	default:
+		// We don't keep timestamps so everything is older than any time
+		offsets = []int64{l.end(), l.base}
+	}
+
+	if int(q.maxNumber) < len(offsets) && q.maxNumber >= 0 {
+		offsets = offsets[:q.maxNumber]
+	}
+	return ErrorCodeNoError, offsets
+}
+
+// Checks the message framing, not the contents
+func validMessageSet(set []byte) bool {
+	for len(set) > 0 {
+		if len(set) < 4 {
+			return false
+		}
+		l := int64(networkOrder.Uint32(set))
+		if l < 5 || l > int64(len(set)-4) {
+			return false
+		}
+		set = set[4+l:]
+	}
+	return true
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		d.b = nil
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) int16() int16 {
+	if p := d.next(2); p != nil {
+		return int16(networkOrder.Uint16(p))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if p := d.next(4); p != nil {
+		return int32(networkOrder.Uint32(p))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if p := d.next(8); p != nil {
+		return int64(networkOrder.Uint64(p))
+	}
+	return 0
+}
+
+func (d *decoder) topicPartition() TopicPartition {
+	topic := string(d.next(int(d.int16())))
+	return TopicPartition{topic, d.int32()}
+}
+
+func (d *decoder) produce() produce {
+	tp := d.topicPartition()
+	set := d.next(int(d.int32()))
+	return produce{tp, append([]byte(nil), set...)}
+}
+
+func (d *decoder) fetch() fetch {
+	return fetch{d.topicPartition(), d.int64(), d.int32()}
+}
+
+func appendInt16(b []byte, v int16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	return appendInt32(appendInt32(b, int32(v>>32)), int32(v))
+}
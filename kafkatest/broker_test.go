@@ -0,0 +1,97 @@
+package kafkatest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func roundTrip(t *testing.T, conn net.Conn, req []byte) []byte {
+	if _, err := conn.Write(append(appendInt32(nil, int32(len(req))), req...)); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, networkOrder.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func fetchRequest(topic string, partition int32, offset int64, maxSize int32) []byte {
+	req := appendInt16(nil, int16(RequestTypeFetch))
+	req = appendInt16(req, int16(len(topic)))
+	req = append(req, topic...)
+	req = appendInt32(req, partition)
+	req = appendInt64(req, offset)
+	return appendInt32(req, maxSize)
+}
+
+func TestFetch(t *testing.T) {
+	b, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	end := b.Produce("foo", 0, []byte("hello"), []byte("there"))
+
+	conn, err := net.Dial("tcp", b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp := roundTrip(t, conn, fetchRequest("foo", 0, 0, 1024))
+	expected := append(appendInt16(nil, ErrorCodeNoError), EncodeMessages([]byte("hello"), []byte("there"))...)
+	if !bytes.Equal(resp, expected) {
+		t.Error("Unexpected fetch response", resp)
+	}
+
+	resp = roundTrip(t, conn, fetchRequest("foo", 0, end+1, 1024))
+	if !bytes.Equal(resp, appendInt16(nil, ErrorCodeOffsetOutOfRange)) {
+		t.Error("Expected offset out of range. got", resp)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	b, err := NewBroker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	b.SetFault(func(req Request) Fault {
+		if req.Targets[0].Topic == "drop" {
+			return Fault{Drop: true}
+		}
+		return Fault{ErrorCode: ErrorCodeWrongPartition}
+	})
+
+	conn, err := net.Dial("tcp", b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp := roundTrip(t, conn, fetchRequest("foo", 0, 0, 1024))
+	if !bytes.Equal(resp, appendInt16(nil, ErrorCodeWrongPartition)) {
+		t.Error("Expected injected error code. got", resp)
+	}
+
+	req := fetchRequest("drop", 0, 0, 1024)
+	if _, err = conn.Write(append(appendInt32(nil, int32(len(req))), req...)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Expected the connection to be dropped. got", err)
+	}
+}
@@ -0,0 +1,193 @@
+package kafka
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Sent by MultiBrokerStream.  Addr is the broker the message came from,
+// which together with the topic and partition names a partition in 0.7.
+type BrokerFetchResponse struct {
+	Addr string
+	FetchResponse
+}
+
+// Reads partitions spread over several brokers.  Every broker gets its own
+// connection and KafkaStream, and their results are merged onto Ch.
+// Messages from one partition arrive in order, but there's no order
+// between partitions.
+//
+// If any broker's stream fails its error is sent on Ch and every stream
+// stops, as if Close was called.
+//
+// Since partition numbers are only unique per broker, a StreamConfig.Store
+// keeps each broker's partitions under the topic "<addr>/<topic>".
+type MultiBrokerStream struct {
+	Ch <-chan BrokerFetchResponse
+
+	ch     chan BrokerFetchResponse
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu    sync.Mutex
+	final map[string][]TopicPartitionOffset
+	err   error
+
+	done chan struct{}
+}
+
+// Starts a stream from the given offsets on each broker address.  Every
+// connection is made with d.
+func NewMultiBrokerStream(ctx context.Context, d Dialer, targets map[string][]TopicPartitionOffset, config StreamConfig) (m *MultiBrokerStream, err error) {
+	return newMultiBrokerStream(ctx, d, keys(targets), func(addr string, c *SimpleConsumer, store OffsetStore) ([]TopicPartitionOffset, error) {
+		return targets[addr], nil
+	}, config)
+}
+
+// Like NewMultiBrokerStream, but starts every partition at startTime, or
+// at its offset in config.Store if it has one.  Discovery.Partitions gives
+// the targets of a set of topics.
+func NewMultiBrokerStreamWithOffsets(ctx context.Context, d Dialer, targets map[string][]TopicPartition, startTime OffsetTime, config StreamConfig) (m *MultiBrokerStream, err error) {
+	return newMultiBrokerStream(ctx, d, keys(targets), func(addr string, c *SimpleConsumer, store OffsetStore) ([]TopicPartitionOffset, error) {
+		return storedOffsets(c, targets[addr], startTime, store)
+	}, config)
+}
+
+func keys[V any](targets map[string]V) (addrs []string) {
+	for addr := range targets {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return
+}
+
+func newMultiBrokerStream(ctx context.Context, d Dialer, addrs []string, offsets func(addr string, c *SimpleConsumer, store OffsetStore) ([]TopicPartitionOffset, error), config StreamConfig) (m *MultiBrokerStream, err error) {
+	conns := make([]*SimpleConsumer, 0, len(addrs))
+	defer func() {
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+		}
+	}()
+
+	starts := make([][]TopicPartitionOffset, len(addrs))
+	configs := make([]StreamConfig, len(addrs))
+	for i, addr := range addrs {
+		var c *SimpleConsumer
+		if c, err = d.DialContext(ctx, addr); err != nil {
+			return nil, err
+		}
+		conns = append(conns, c)
+
+		configs[i] = config
+		if config.Store != nil {
+			configs[i].Store = brokerOffsetStore{config.Store, addr}
+		}
+		if starts[i], err = offsets(addr, c, configs[i].Store); err != nil {
+			return nil, err
+		}
+	}
+
+	ch := make(chan BrokerFetchResponse)
+	m = &MultiBrokerStream{
+		Ch:    ch,
+		ch:    ch,
+		final: make(map[string][]TopicPartitionOffset),
+		done:  make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		s := newKafkaStream(m.ctx, conns[i], starts[i], configs[i])
+		s.deliver = func(ctx context.Context, res FetchResponse) bool {
+			select {
+			case m.ch <- BrokerFetchResponse{addr, res}:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		go s.pollLoop()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.finish(addr, s)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		for _, c := range conns {
+			c.Close()
+		}
+		close(m.ch)
+		close(m.done)
+	}()
+	return m, nil
+}
+
+// Waits for one broker's stream to stop and stops the rest.  The stream
+// sends straight to Ch, so its offsets only move past messages Ch took.
+func (m *MultiBrokerStream) finish(addr string, s *KafkaStream) {
+	<-s.Done()
+	final, err := s.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.final[addr] = final
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+	m.cancel()
+}
+
+// Stops every broker's stream, closes their connections and closes Ch.
+// Returns each broker's offsets as KafkaStream.Close does, and the error
+// that stopped the streams if one failed first.
+func (m *MultiBrokerStream) Close() (offsets map[string][]TopicPartitionOffset, err error) {
+	m.cancel()
+	<-m.done
+	return m.final, m.err
+}
+
+// Closed once every broker's stream has stopped
+func (m *MultiBrokerStream) Done() <-chan struct{} {
+	return m.done
+}
+
+// One broker's share of an OffsetStore, with its topics prefixed by the
+// broker's address
+type brokerOffsetStore struct {
+	OffsetStore
+	addr string
+}
+
+func (b brokerOffsetStore) Load() (map[TopicPartition]Offset, error) {
+	saved, err := b.OffsetStore.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := b.addr + "/"
+	offsets := make(map[TopicPartition]Offset)
+	for tp, o := range saved {
+		if topic, ok := strings.CutPrefix(tp.Topic, prefix); ok {
+			offsets[TopicPartition{topic, tp.Partition}] = o
+		}
+	}
+	return offsets, nil
+}
+
+func (b brokerOffsetStore) Commit(offsets map[TopicPartition]Offset) error {
+	prefixed := make(map[TopicPartition]Offset, len(offsets))
+	for tp, o := range offsets {
+		prefixed[TopicPartition{b.addr + "/" + tp.Topic, tp.Partition}] = o
+	}
+	return b.OffsetStore.Commit(prefixed)
+}
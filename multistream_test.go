@@ -0,0 +1,222 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiBrokerStream(t *testing.T) {
+	b0 := newTestBroker(t)
+	defer b0.Close()
+	b1 := newTestBroker(t)
+	defer b1.Close()
+
+	// Both brokers number their partitions of foo from 0
+	s, d, done := newTestDiscovery(t)
+	defer done()
+	s.Set("/brokers/ids/0", []byte("creator:"+b0.Addr))
+	s.Set("/brokers/ids/1", []byte("creator:"+b1.Addr))
+	s.Set("/brokers/topics/foo/0", []byte("2"))
+	s.Set("/brokers/topics/foo/1", []byte("1"))
+
+	targets, err := d.Partitions("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMultiBrokerStreamWithOffsets(context.Background(), Dialer{}, targets, OffsetTimeEarliest, StreamConfig{
+		MinPollInterval: 5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 20
+	type partition struct {
+		addr string
+		tp   TopicPartition
+	}
+	ends := make(map[partition]int64)
+	for i := range n {
+		ends[partition{b0.Addr, TopicPartition{"foo", 0}}] = b0.Produce("foo", 0, []byte(fmt.Sprint(i)))
+		ends[partition{b0.Addr, TopicPartition{"foo", 1}}] = b0.Produce("foo", 1, []byte(fmt.Sprint(i)))
+		ends[partition{b1.Addr, TopicPartition{"foo", 0}}] = b1.Produce("foo", 0, []byte(fmt.Sprint(i)))
+	}
+
+	got := make(map[partition][]string)
+	for count := 0; count < 3*n; count++ {
+		select {
+		case res := <-m.Ch:
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			p := partition{res.Addr, res.TopicPartition}
+			got[p] = append(got[p], string(res.Message))
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected", 3*n, "messages. got", got)
+		}
+	}
+
+	var expected []string
+	for i := range n {
+		expected = append(expected, fmt.Sprint(i))
+	}
+	for p := range ends {
+		if !reflect.DeepEqual(got[p], expected) {
+			t.Error("Expected", p, "in order. got", got[p])
+		}
+	}
+
+	offsets, err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedOffsets := map[string][]TopicPartitionOffset{
+		b0.Addr: {
+			{TopicPartition{"foo", 0}, Offset(ends[partition{b0.Addr, TopicPartition{"foo", 0}}])},
+			{TopicPartition{"foo", 1}, Offset(ends[partition{b0.Addr, TopicPartition{"foo", 1}}])},
+		},
+		b1.Addr: {
+			{TopicPartition{"foo", 0}, Offset(ends[partition{b1.Addr, TopicPartition{"foo", 0}}])},
+		},
+	}
+	if !reflect.DeepEqual(offsets, expectedOffsets) {
+		t.Error("Expected", expectedOffsets, "got", offsets)
+	}
+	if _, ok := <-m.Ch; ok {
+		t.Error("Expected Ch to be closed")
+	}
+}
+
+func TestMultiBrokerStreamError(t *testing.T) {
+	b0 := newTestBroker(t)
+	defer b0.Close()
+	b1 := newTestBroker(t)
+	defer b1.Close()
+
+	m, err := NewMultiBrokerStream(context.Background(), Dialer{}, map[string][]TopicPartitionOffset{
+		b0.Addr: {{TopicPartition{"foo", 0}, 0}},
+		b1.Addr: {{TopicPartition{"foo", 0}, 0}},
+	}, StreamConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Losing one broker stops the other too
+	b1.Close()
+
+	select {
+	case res := <-m.Ch:
+		if res.Addr != b1.Addr || res.Err == nil {
+			t.Error("Expected an error from", b1.Addr, "got", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an error")
+	}
+	select {
+	case <-m.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to stop")
+	}
+	if _, ok := <-m.Ch; ok {
+		t.Error("Expected Ch to be closed")
+	}
+	if _, err = m.Close(); err == nil {
+		t.Error("Expected Close to return the error")
+	}
+}
+
+func TestMultiBrokerStreamDialError(t *testing.T) {
+	b := newTestBroker(t)
+	addr := b.Addr
+	b.Close()
+
+	_, err := NewMultiBrokerStream(context.Background(), Dialer{}, map[string][]TopicPartitionOffset{
+		addr: {{TopicPartition{"foo", 0}, 0}},
+	}, StreamConfig{})
+	if err == nil {
+		t.Error("Expected the dial to fail")
+	}
+}
+
+func TestMultiBrokerStreamStore(t *testing.T) {
+	b0 := newTestBroker(t)
+	defer b0.Close()
+	b1 := newTestBroker(t)
+	defer b1.Close()
+
+	tp := TopicPartition{"foo", 0}
+	end0 := b0.Produce("foo", 0, []byte("zero"))
+	end1 := b1.Produce("foo", 0, []byte("one"))
+
+	// Both brokers have a foo-0, which mustn't share an offset
+	store := NewMemoryOffsetStore()
+	store.Commit(map[TopicPartition]Offset{{b1.Addr + "/foo", 0}: Offset(end1)})
+
+	targets := map[string][]TopicPartition{b0.Addr: {tp}, b1.Addr: {tp}}
+	m, err := NewMultiBrokerStreamWithOffsets(context.Background(), Dialer{}, targets, OffsetTimeEarliest, StreamConfig{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-m.Ch:
+		if res.Err != nil || res.Addr != b0.Addr || string(res.Message) != "zero" {
+			t.Error("Expected zero from", b0.Addr, "got", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a message")
+	}
+
+	if _, err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	offsets, _ := store.Load()
+	expected := map[TopicPartition]Offset{
+		{b0.Addr + "/foo", 0}: Offset(end0),
+		{b1.Addr + "/foo", 0}: Offset(end1),
+	}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Error("Expected", expected, "got", offsets)
+	}
+}
+
+func TestMultiBrokerStreamCloseUnread(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	for i := range 5 {
+		b.Produce("foo", 0, []byte(fmt.Sprint(i)))
+	}
+
+	store := NewMemoryOffsetStore()
+	targets := map[string][]TopicPartitionOffset{b.Addr: {{tp, 0}}}
+	m, err := NewMultiBrokerStream(context.Background(), Dialer{}, targets, StreamConfig{Store: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the stream time to fetch what it can't deliver
+	time.Sleep(50 * time.Millisecond)
+
+	offsets, err := m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(offsets, targets) {
+		t.Error("Expected", targets, "got", offsets)
+	}
+
+	// Nothing was read, so nothing is past the start
+	saved, _ := store.Load()
+	for tp, o := range saved {
+		if o != 0 {
+			t.Error("Expected", tp, "to be committed at 0. got", o)
+		}
+	}
+}
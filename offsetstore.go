@@ -0,0 +1,166 @@
+package kafka
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Somewhere to keep a stream's positions across restarts.  Offsets are the
+// offset of the next message to read, as in FetchResponse.
+type OffsetStore interface {
+	// Returns every saved offset.  Partitions that were never committed
+	// are missing.
+	Load() (map[TopicPartition]Offset, error)
+
+	// Saves offsets, leaving partitions not in it alone
+	Commit(offsets map[TopicPartition]Offset) error
+}
+
+// Keeps offsets in memory, which is mostly useful for tests and for
+// sharing positions between streams in one process.  Safe for concurrent
+// use.
+type MemoryOffsetStore struct {
+	mu      sync.Mutex
+	offsets map[TopicPartition]Offset
+}
+
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: make(map[TopicPartition]Offset)}
+}
+
+func (m *MemoryOffsetStore) Load() (map[TopicPartition]Offset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	offsets := make(map[TopicPartition]Offset, len(m.offsets))
+	for tp, o := range m.offsets {
+		offsets[tp] = o
+	}
+	return offsets, nil
+}
+
+func (m *MemoryOffsetStore) Commit(offsets map[TopicPartition]Offset) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for tp, o := range offsets {
+		m.offsets[tp] = o
+	}
+	return nil
+}
+
+// Keeps offsets in a JSON file.  Each commit writes a new file next to it
+// and renames it into place, so a crash leaves either the old offsets or
+// the new ones but never a mix.  Safe for concurrent use within a process.
+type FileOffsetStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{Path: path}
+}
+
+type fileOffset struct {
+	Topic     string    `json:"topic"`
+	Partition Partition `json:"partition"`
+	Offset    Offset    `json:"offset"`
+}
+
+// A missing file is the same as an empty one
+func (f *FileOffsetStore) Load() (map[TopicPartition]Offset, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.load()
+}
+
+func (f *FileOffsetStore) load() (offsets map[TopicPartition]Offset, err error) {
+	offsets = make(map[TopicPartition]Offset)
+
+	data, err := os.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var saved []fileOffset
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, o := range saved {
+		offsets[TopicPartition{o.Topic, o.Partition}] = o.Offset
+	}
+	return offsets, nil
+}
+
+func (f *FileOffsetStore) Commit(offsets map[TopicPartition]Offset) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	merged, err := f.load()
+	if err != nil {
+		return err
+	}
+	for tp, o := range offsets {
+		merged[tp] = o
+	}
+
+	saved := make([]fileOffset, 0, len(merged))
+	for tp, o := range merged {
+		saved = append(saved, fileOffset{tp.Topic, tp.Partition, o})
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		if saved[i].Topic != saved[j].Topic {
+			return saved[i].Topic < saved[j].Topic
+		}
+		return saved[i].Partition < saved[j].Partition
+	})
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(f.Path, data)
+}
+
+// Writes data to a temporary file in path's directory, syncs it and renames
+// it over path
+func writeFileAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
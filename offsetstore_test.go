@@ -0,0 +1,161 @@
+package kafka
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testOffsetStore(t *testing.T, store OffsetStore) {
+	offsets, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 0 {
+		t.Fatal("Expected no offsets yet. got", offsets)
+	}
+
+	foo, bar := TopicPartition{"foo", 0}, TopicPartition{"bar", 1}
+	if err = store.Commit(map[TopicPartition]Offset{foo: 10, bar: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Commit(map[TopicPartition]Offset{foo: 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	if offsets, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[TopicPartition]Offset{foo: 30, bar: 20}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Error("Expected", expected, "got", offsets)
+	}
+}
+
+func TestMemoryOffsetStore(t *testing.T) {
+	testOffsetStore(t, NewMemoryOffsetStore())
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "offsets.json")
+	testOffsetStore(t, NewFileOffsetStore(path))
+
+	// A new store reads what the last one wrote
+	offsets, err := NewFileOffsetStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offsets[TopicPartition{"foo", 0}] != 30 {
+		t.Error("Expected foo at 30. got", offsets)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Error("Expected only the offsets file to be left. got", entries)
+	}
+
+	if err = os.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewFileOffsetStore(path).Load(); err == nil {
+		t.Error("Expected an error for a corrupt file")
+	}
+}
+
+func TestStreamOffsetStore(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	first := b.Produce("foo", 0, []byte("seen"))
+	end := b.Produce("foo", 0, []byte("hello"), []byte("there"))
+
+	store := NewMemoryOffsetStore()
+	store.Commit(map[TopicPartition]Offset{tp: Offset(first)})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := NewKafkaStreamWithStore(c, []TopicPartition{tp}, OffsetTimeEarliest, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"hello", "there"} {
+		select {
+		case res := <-s.Ch:
+			if res.Err != nil || string(res.Message) != expected {
+				t.Fatal("Expected", expected, "got", res)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected", expected)
+		}
+	}
+
+	// The stream commits when it stops
+	if _, err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if offsets, _ := store.Load(); offsets[tp] != Offset(end) {
+		t.Error("Expected", end, "to be committed. got", offsets)
+	}
+}
+
+func TestStreamConfigStore(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp := TopicPartition{"foo", 0}
+	deleted := b.Produce("foo", 0, []byte("deleted"))
+	end := b.Produce("foo", 0, []byte("hello"))
+	b.Truncate("foo", 0, deleted)
+
+	// The stored offset is gone, so the reset policy has to apply to it
+	store := NewMemoryOffsetStore()
+	store.Commit(map[TopicPartition]Offset{tp: 0})
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewKafkaStreamAt(ctx, c, []TopicPartition{tp}, OffsetTimeLatest, StreamConfig{
+		OffsetReset:    OffsetResetEarliest,
+		Store:          store,
+		CommitInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectStreamMessage(t, s, tp, "hello")
+
+	// Committed on the interval, without the stream stopping
+	deadline := time.Now().Add(time.Second)
+	for {
+		offsets, _ := store.Load()
+		if offsets[tp] == Offset(end) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected", end, "to be committed. got", offsets)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	<-s.Done()
+}
@@ -0,0 +1,60 @@
+package kafka
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"unicode/utf16"
+)
+
+// Picks which of a topic's numPartitions partitions a message with the
+// given key goes to.  Must return a value in [0, numPartitions).
+type Partitioner interface {
+	Partition(key []byte, numPartitions int32) Partition
+}
+
+// Sends equal keys to the same partition.  Matches the JVM client's
+// DefaultPartitioner for string keys: abs(key.hashCode) % numPartitions,
+// with key read as UTF-8.  Like the JVM client a nil key goes to a random
+// partition.
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key []byte, numPartitions int32) Partition {
+	if key == nil {
+		return Partition(rand.Int31n(numPartitions))
+	}
+
+	p := javaStringHash(key) % numPartitions
+	if p < 0 {
+		// Only for a hash of math.MinInt32, where abs stays negative and the
+		// JVM client would pick an invalid partition
+		p += numPartitions
+	}
+	return Partition(p)
+}
+
+// String.hashCode, which works on UTF-16 code units
+func javaStringHash(key []byte) (h int32) {
+	for _, u := range utf16.Encode([]rune(string(key))) {
+		h = 31*h + int32(u)
+	}
+	if h < 0 {
+		h = -h
+	}
+	return
+}
+
+// Cycles through the partitions, ignoring the key
+type RoundRobinPartitioner struct {
+	next atomic.Uint32
+}
+
+func (r *RoundRobinPartitioner) Partition(key []byte, numPartitions int32) Partition {
+	return Partition((r.next.Add(1) - 1) % uint32(numPartitions))
+}
+
+// Picks a partition at random, ignoring the key
+type RandomPartitioner struct{}
+
+func (RandomPartitioner) Partition(key []byte, numPartitions int32) Partition {
+	return Partition(rand.Int31n(numPartitions))
+}
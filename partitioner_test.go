@@ -0,0 +1,42 @@
+package kafka
+
+import (
+	"testing"
+)
+
+func TestHashPartitioner(t *testing.T) {
+	// Expected values from the JVM: Math.abs(key.hashCode()) % 10
+	for _, tc := range []struct {
+		key       string
+		partition Partition
+	}{
+		{"", 0},
+		{"a", 7},                  // 97
+		{"hello", 2},              // 99162322
+		{"user-12345", 3},         // 440384433
+		{"héllo", 4},              // 103094734
+		{"\U0001f4a9", 6},         // 1772556, from a surrogate pair
+		{"polygenelubricants", 2}, // -2147483648, which the JVM maps to -8
+	} {
+		if p := (HashPartitioner{}).Partition([]byte(tc.key), 10); p != tc.partition {
+			t.Errorf("Key %q expected partition %d. got %d", tc.key, tc.partition, p)
+		}
+	}
+}
+
+func TestRoundRobinPartitioner(t *testing.T) {
+	var r RoundRobinPartitioner
+	for i := 0; i < 7; i++ {
+		if p := r.Partition(nil, 3); p != Partition(i%3) {
+			t.Errorf("Call %d expected partition %d. got %d", i, i%3, p)
+		}
+	}
+}
+
+func TestRandomPartitioner(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if p := (RandomPartitioner{}).Partition(nil, 3); p < 0 || p >= 3 {
+			t.Fatal("Expected a partition below 3. got", p)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Where a Producer sends its batches.  Both SimpleConsumer and
+// ReconnectingConsumer will do.
+type ProduceClient interface {
+	MultiProduceContext(ctx context.Context, req MultiProduceRequest) error
+}
+
+// When a Producer sends what it has buffered.  Zero values use the
+// defaults.
+type ProducerConfig struct {
+	// Send once this many messages are buffered
+	BatchCount int
+	// Send once the buffered messages, with their headers, take up this
+	// many bytes
+	BatchBytes int
+	// Send this long after the first message was buffered even if neither
+	// limit has been reached
+	Linger time.Duration
+
+	// Compression for every batch.  None falls back to the client's
+	// default, and ForceNone sends batches uncompressed regardless.
+	Compression CompressionType
+
+	// Picks partitions for SendKeyed.  HashPartitioner if nil.
+	Partitioner Partitioner
+	// How many partitions each topic passed to SendKeyed has
+	Partitions map[string]int32
+}
+
+const (
+	defaultBatchCount = 200
+	defaultBatchBytes = 1024 * 1024
+	defaultLinger     = 100 * time.Millisecond
+)
+
+var ErrProducerClosed = errors.New("Producer is closed")
+
+// Buffers messages per TopicPartition and sends them together as
+// MultiProduceRequests.  Send only blocks when it fills a batch and has to
+// write it.  Batches sent because they lingered long enough are written in
+// the background; if one fails its error is returned by the next call to
+// Send, Flush or Close.  Either way the messages of a failed batch are
+// dropped.
+//
+// A Producer is safe for concurrent use.  Messages sent to the same
+// TopicPartition from one goroutine are written in order.
+type Producer struct {
+	client ProduceClient
+	config ProducerConfig
+
+	// Held while taking a batch and writing it so batches go out in order
+	sendLock sync.Mutex
+
+	mu sync.Mutex
+	// Partitions in the order they were first buffered
+	order   []TopicPartition
+	batches map[TopicPartition]Messages
+	count   int
+	bytes   int
+	// Fires the linger flush, set while anything is buffered
+	timer  *time.Timer
+	err    error
+	closed bool
+}
+
+func NewProducer(client ProduceClient, config ProducerConfig) *Producer {
+	if config.BatchCount <= 0 {
+		config.BatchCount = defaultBatchCount
+	}
+	if config.BatchBytes <= 0 {
+		config.BatchBytes = defaultBatchBytes
+	}
+	if config.Linger <= 0 {
+		config.Linger = defaultLinger
+	}
+	if config.Partitioner == nil {
+		config.Partitioner = HashPartitioner{}
+	}
+
+	return &Producer{
+		client:  client,
+		config:  config,
+		batches: make(map[TopicPartition]Messages),
+	}
+}
+
+// Buffers msg for tp.  Returns the error of a failed background send if
+// there was one since the last call.
+func (p *Producer) Send(tp TopicPartition, msg Message) (err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProducerClosed
+	}
+
+	if _, ok := p.batches[tp]; !ok {
+		p.order = append(p.order, tp)
+	}
+	p.batches[tp] = append(p.batches[tp], msg)
+	p.count++
+	p.bytes += int(msg.Len())
+
+	if p.timer == nil {
+		p.timer = time.AfterFunc(p.config.Linger, p.linger)
+	}
+
+	full := p.count >= p.config.BatchCount || p.bytes >= p.config.BatchBytes
+	err, p.err = p.err, nil
+	p.mu.Unlock()
+
+	if full {
+		if sendErr := p.send(); err == nil {
+			err = sendErr
+		}
+	}
+	return
+}
+
+// Like Send, with the partition picked by the Partitioner from key
+func (p *Producer) SendKeyed(topic string, key []byte, msg Message) error {
+	n := p.config.Partitions[topic]
+	if n <= 0 {
+		return fmt.Errorf("Unknown number of partitions for topic %s", topic)
+	}
+	return p.Send(TopicPartition{topic, p.config.Partitioner.Partition(key, n)}, msg)
+}
+
+// Sends everything buffered so far and waits for it to be written.
+// Returns the first error since the last call.
+func (p *Producer) Flush() (err error) {
+	err = p.send()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		if err == nil {
+			err = p.err
+		}
+		p.err = nil
+	}
+	return
+}
+
+// Flushes and stops taking messages.  Doesn't close the client.
+func (p *Producer) Close() (err error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrProducerClosed
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	return p.Flush()
+}
+
+func (p *Producer) linger() {
+	if err := p.send(); err != nil {
+		p.mu.Lock()
+		if p.err == nil {
+			p.err = err
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Takes whatever is buffered and writes it as one request
+func (p *Producer) send() error {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	req := p.take()
+	if len(req) == 0 {
+		return nil
+	}
+	return p.client.MultiProduceContext(context.Background(), req)
+}
+
+func (p *Producer) take() (req MultiProduceRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	req = make(MultiProduceRequest, 0, len(p.order))
+	for _, tp := range p.order {
+		req = append(req, ProduceRequest{
+			TopicPartition: tp,
+			Messages:       p.batches[tp],
+			Compression:    p.config.Compression,
+		})
+	}
+
+	p.order = nil
+	p.batches = make(map[TopicPartition]Messages)
+	p.count, p.bytes = 0, 0
+	return
+}
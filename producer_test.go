@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingClient struct {
+	mu   sync.Mutex
+	reqs []MultiProduceRequest
+	err  error
+}
+
+func (c *recordingClient) MultiProduceContext(ctx context.Context, req MultiProduceRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reqs = append(c.reqs, req)
+	return c.err
+}
+
+func (c *recordingClient) requests() []MultiProduceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]MultiProduceRequest(nil), c.reqs...)
+}
+
+func TestProducerBatchCount(t *testing.T) {
+	client := &recordingClient{}
+	p := NewProducer(client, ProducerConfig{BatchCount: 3, Linger: time.Hour})
+
+	foo, bar := TopicPartition{"foo", 0}, TopicPartition{"bar", 1}
+	for _, tp := range []TopicPartition{foo, bar, foo, bar} {
+		if err := p.Send(tp, Message("hi")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reqs := client.requests()
+	if len(reqs) != 1 {
+		t.Fatal("Expected one request once the batch filled. got", len(reqs))
+	}
+	if len(reqs[0]) != 2 || reqs[0][0].TopicPartition != foo || len(reqs[0][0].Messages) != 2 ||
+		reqs[0][1].TopicPartition != bar || len(reqs[0][1].Messages) != 1 {
+		t.Error("Expected 2 messages for foo then 1 for bar. got", reqs[0])
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs = client.requests()
+	if len(reqs) != 2 || len(reqs[1]) != 1 || reqs[1][0].TopicPartition != bar {
+		t.Error("Expected Close to send the last message for bar. got", reqs)
+	}
+
+	if err := p.Send(foo, Message("late")); err != ErrProducerClosed {
+		t.Error("Expected ErrProducerClosed. got", err)
+	}
+}
+
+func TestProducerBatchBytes(t *testing.T) {
+	client := &recordingClient{}
+	p := NewProducer(client, ProducerConfig{BatchBytes: 100, Linger: time.Hour})
+
+	tp := TopicPartition{"foo", 0}
+	p.Send(tp, make(Message, 50))
+	if len(client.requests()) != 0 {
+		t.Fatal("Expected nothing sent yet")
+	}
+
+	p.Send(tp, make(Message, 50))
+	if reqs := client.requests(); len(reqs) != 1 || len(reqs[0][0].Messages) != 2 {
+		t.Error("Expected both messages sent. got", reqs)
+	}
+}
+
+func TestProducerLinger(t *testing.T) {
+	client := &recordingClient{err: errors.New("broker on fire")}
+	p := NewProducer(client, ProducerConfig{Linger: 10 * time.Millisecond})
+
+	p.Send(TopicPartition{"foo", 0}, Message("hi"))
+
+	deadline := time.Now().Add(time.Second)
+	for len(client.requests()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the batch to be sent after lingering")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Flush(); err != client.err {
+		t.Error("Expected the background send's error. got", err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Error("Expected the error to be reported once. got", err)
+	}
+}
+
+func TestProducerBroker(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := NewProducer(c, ProducerConfig{Compression: CompressionTypeGZip})
+	for _, s := range []string{"hello", "there"} {
+		if err = p.Send(TopicPartition{"foo", 0}, Message(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fetchAll(t, c, TopicPartition{"foo", 0}); len(got) != 2 || got[0] != "hello" || got[1] != "there" {
+		t.Error("Expected hello and there. got", got)
+	}
+}
+
+func TestProducerSendKeyed(t *testing.T) {
+	client := &recordingClient{}
+	p := NewProducer(client, ProducerConfig{
+		Linger:     time.Hour,
+		Partitions: map[string]int32{"foo": 4},
+	})
+
+	for _, key := range []string{"a", "b", "a"} {
+		if err := p.SendKeyed("foo", []byte(key), Message(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.SendKeyed("bar", []byte("a"), Message("a")); err == nil {
+		t.Error("Expected an error for a topic with no partition count")
+	}
+	p.Flush()
+
+	reqs := client.requests()
+	if len(reqs) != 1 || len(reqs[0]) != 2 {
+		t.Fatal("Expected one request for two partitions. got", reqs)
+	}
+	// "a".hashCode() is 97 and "b".hashCode() is 98
+	if reqs[0][0].TopicPartition != (TopicPartition{"foo", 1}) || len(reqs[0][0].Messages) != 2 {
+		t.Error("Expected both a's on partition 1. got", reqs[0][0])
+	}
+	if reqs[0][1].TopicPartition != (TopicPartition{"foo", 2}) {
+		t.Error("Expected b on partition 2. got", reqs[0][1])
+	}
+}
+
+func TestProducerSendKeyedNilKey(t *testing.T) {
+	client := &recordingClient{}
+	p := NewProducer(client, ProducerConfig{
+		Linger:      time.Hour,
+		Partitions:  map[string]int32{"foo": 2},
+		Partitioner: &RoundRobinPartitioner{},
+	})
+
+	// The configured Partitioner picks for nil keys too
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		if err := p.SendKeyed("foo", nil, Message(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Flush()
+
+	reqs := client.requests()
+	if len(reqs) != 1 || len(reqs[0]) != 2 {
+		t.Fatal("Expected one request for two partitions. got", reqs)
+	}
+	for i, expected := range [][]string{{"a", "c"}, {"b", "d"}} {
+		req := reqs[0][i]
+		if req.Partition != Partition(i) || len(req.Messages) != 2 ||
+			string(req.Messages[0]) != expected[0] || string(req.Messages[1]) != expected[1] {
+			t.Error("Expected", expected, "on partition", i, "got", req)
+		}
+	}
+}
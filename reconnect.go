@@ -0,0 +1,425 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Bounds of the exponential backoff between dial attempts.  Zero values
+// use the defaults.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// Returns how long to wait before dial attempt n (starting at 0).  Each
+// wait is somewhere between half and all of Min * 2^n, capped at Max, so
+// clients that lost the same broker don't all come back at once.
+func (b Backoff) delay(n int) time.Duration {
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	d := min
+	for i := 0; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Returned by ReconnectingConsumer for produce requests that were being
+// written when the connection was lost.  The broker may or may not have
+// gotten the messages, so sending them again may duplicate them.
+type RetriableError struct {
+	Err error
+}
+
+func (e *RetriableError) Error() string {
+	return fmt.Sprintf("Connection lost while producing, retrying may duplicate messages: %v", e.Err)
+}
+
+func (e *RetriableError) Unwrap() error {
+	return e.Err
+}
+
+// A client for a single broker that redials whenever the connection is
+// lost.  Fetch, MultiFetch and Offsets requests that were in flight are
+// sent again on the new connection, picking up after the last message that
+// was delivered.  Produce requests are never resent; see RetriableError.
+//
+// Like SimpleConsumer it is safe for concurrent use.
+type ReconnectingConsumer struct {
+	dial    func(ctx context.Context) (*SimpleConsumer, error)
+	backoff Backoff
+
+	mu sync.Mutex
+	c  *SimpleConsumer
+	// Closed when the connection after c is up
+	next   chan struct{}
+	closed bool
+
+	compression  CompressionType
+	legacyFormat bool
+
+	done chan struct{}
+}
+
+// Dials addr and keeps redialing it with the given backoff whenever the
+// connection is lost.  Fails if the first dial does.
+func DialReconnecting(addr string, backoff Backoff) (*ReconnectingConsumer, error) {
+	var d Dialer
+	return d.DialReconnecting(addr, backoff)
+}
+
+func newReconnectingConsumer(ctx context.Context, dial func(ctx context.Context) (*SimpleConsumer, error), backoff Backoff) (*ReconnectingConsumer, error) {
+	c, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ReconnectingConsumer{
+		dial:    dial,
+		backoff: backoff,
+		c:       c,
+		next:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.supervise(c)
+	return r, nil
+}
+
+// Waits for each connection to die and replaces it
+func (r *ReconnectingConsumer) supervise(c *SimpleConsumer) {
+	for {
+		select {
+		case <-c.done:
+		case <-r.done:
+			return
+		}
+		log.Println("Lost connection, redialing:", c.Err())
+
+		if c = r.redial(); c == nil {
+			return
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			c.Close()
+			return
+		}
+		c.SetCompression(r.compression)
+		c.SetLegacyFormat(r.legacyFormat)
+		r.c = c
+		next := r.next
+		r.next = make(chan struct{})
+		r.mu.Unlock()
+
+		close(next)
+	}
+}
+
+// Dials until it works.  Returns nil if we get closed first.
+func (r *ReconnectingConsumer) redial() *SimpleConsumer {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-time.After(r.backoff.delay(attempt)):
+		case <-r.done:
+			return nil
+		}
+
+		c, err := r.dial(ctx)
+		if err == nil {
+			return c
+		}
+		log.Println("Redial failed:", err)
+	}
+}
+
+// Returns a live connection, waiting for a redial if needed
+func (r *ReconnectingConsumer) current(ctx context.Context) (*SimpleConsumer, error) {
+	for {
+		r.mu.Lock()
+		c, next, closed := r.c, r.next, r.closed
+		r.mu.Unlock()
+
+		if closed {
+			return nil, ErrClosed
+		}
+		if c.Err() == nil {
+			return c, nil
+		}
+
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-r.done:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// Whether a request that failed with err should be sent again on the next
+// connection.  A response cut short by a broken connection doesn't always
+// fail with Err itself, so any failure once c has failed counts.
+func lostConnection(c *SimpleConsumer, err error) bool {
+	connErr := c.Err()
+	return err != nil && connErr != nil && connErr != ErrClosed
+}
+
+// Closes the current connection and stops redialing.  Waiting requests get
+// ErrClosed.
+func (r *ReconnectingConsumer) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	c := r.c
+	r.mu.Unlock()
+
+	close(r.done)
+	c.Close()
+	return nil
+}
+
+// See SimpleConsumer.SetCompression.  Applies to every later connection too.
+func (r *ReconnectingConsumer) SetCompression(compression CompressionType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.compression = compression
+	r.c.SetCompression(compression)
+}
+
+// See SimpleConsumer.SetLegacyFormat.  Applies to every later connection too.
+func (r *ReconnectingConsumer) SetLegacyFormat(legacy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.legacyFormat = legacy
+	r.c.SetLegacyFormat(legacy)
+}
+
+func (r *ReconnectingConsumer) Fetch(req FetchRequest) (results FetchResponseChan, err error) {
+	return r.FetchContext(context.Background(), req)
+}
+
+func (r *ReconnectingConsumer) FetchContext(ctx context.Context, req FetchRequest) (results FetchResponseChan, err error) {
+	return r.fetch(ctx, MultiFetchRequest{req}, true)
+}
+
+func (r *ReconnectingConsumer) MultiFetch(req MultiFetchRequest) (results FetchResponseChan, err error) {
+	return r.MultiFetchContext(context.Background(), req)
+}
+
+func (r *ReconnectingConsumer) MultiFetchContext(ctx context.Context, req MultiFetchRequest) (results FetchResponseChan, err error) {
+	return r.fetch(ctx, req, false)
+}
+
+// Sends the fetch and forwards its results.  If the connection is lost
+// partway through we send whatever is left of it again on the next one.
+func (r *ReconnectingConsumer) fetch(ctx context.Context, req MultiFetchRequest, single bool) (results FetchResponseChan, err error) {
+	// We move the offsets along as messages arrive so keep our own copy
+	pending := make(MultiFetchRequest, len(req))
+	copy(pending, req)
+
+	issue := func() (*SimpleConsumer, FetchResponseChan, error) {
+		for {
+			c, err := r.current(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			var ch FetchResponseChan
+			if single {
+				ch, err = c.FetchContext(ctx, pending[0])
+			} else {
+				ch, err = c.MultiFetchContext(ctx, pending)
+			}
+			if err == nil || !lostConnection(c, err) {
+				return c, ch, err
+			}
+		}
+	}
+
+	c, inner, err := issue()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(FetchResponseChan)
+	go func() {
+		defer close(out)
+
+		for {
+			lost := false
+			for res := range inner {
+				if res.Err != nil && lostConnection(c, res.Err) {
+					lost = true
+					continue
+				}
+
+				pending = advance(pending, res)
+
+				select {
+				case out <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if !lost || len(pending) == 0 {
+				return
+			}
+
+			var issueErr error
+			if c, inner, issueErr = issue(); issueErr != nil {
+				select {
+				case out <- FetchResponse{Err: issueErr}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Moves the partition res belongs to past it.  Partitions that failed are
+// dropped since their error has been delivered.
+func advance(pending MultiFetchRequest, res FetchResponse) MultiFetchRequest {
+	for i := range pending {
+		if pending[i].TopicPartition != res.TopicPartition {
+			continue
+		}
+		if res.Err != nil {
+			return append(pending[:i], pending[i+1:]...)
+		}
+		pending[i].Offset = res.Offset
+		break
+	}
+	return pending
+}
+
+func (r *ReconnectingConsumer) Offsets(req OffsetsRequest) (results OffsetsResponseChan, err error) {
+	return r.OffsetsContext(context.Background(), req)
+}
+
+func (r *ReconnectingConsumer) OffsetsContext(ctx context.Context, req OffsetsRequest) (results OffsetsResponseChan, err error) {
+	issue := func() (*SimpleConsumer, OffsetsResponseChan, error) {
+		for {
+			c, err := r.current(ctx)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			ch, err := c.OffsetsContext(ctx, req)
+			if err == nil || !lostConnection(c, err) {
+				return c, ch, err
+			}
+		}
+	}
+
+	c, inner, err := issue()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(OffsetsResponseChan)
+	go func() {
+		defer close(out)
+
+		for {
+			res, ok := <-inner
+			if !ok {
+				return
+			}
+
+			if res.Err == nil || !lostConnection(c, res.Err) {
+				select {
+				case out <- res:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			var issueErr error
+			if c, inner, issueErr = issue(); issueErr != nil {
+				select {
+				case out <- OffsetsResponse{Err: issueErr}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (r *ReconnectingConsumer) Produce(req *ProduceRequest) (err error) {
+	return r.ProduceContext(context.Background(), req)
+}
+
+// Waits for a connection if we're between them.  If the connection is lost
+// while writing the error is a *RetriableError.
+func (r *ReconnectingConsumer) ProduceContext(ctx context.Context, req *ProduceRequest) (err error) {
+	c, err := r.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = c.ProduceContext(ctx, req); err != nil && lostConnection(c, err) {
+		return &RetriableError{err}
+	}
+	return
+}
+
+func (r *ReconnectingConsumer) MultiProduce(req MultiProduceRequest) (err error) {
+	return r.MultiProduceContext(context.Background(), req)
+}
+
+// See ProduceContext
+func (r *ReconnectingConsumer) MultiProduceContext(ctx context.Context, req MultiProduceRequest) (err error) {
+	c, err := r.current(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err = c.MultiProduceContext(ctx, req); err != nil && lostConnection(c, err) {
+		return &RetriableError{err}
+	}
+	return
+}
@@ -0,0 +1,186 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/kafkatest"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond}
+
+	for n, max := range []time.Duration{10, 20, 40, 80, 100, 100} {
+		max *= time.Millisecond
+		d := b.delay(n)
+		if d < max/2 || d > max {
+			t.Error("Attempt", n, "expected a delay between", max/2, "and", max, "got", d)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	b.Produce("foo", 0, []byte("hello"), []byte("there"))
+
+	r, err := DialReconnecting(b.Addr, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	fr := FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024}
+
+	b.DropConnections()
+
+	fres, err := r.Fetch(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for res := range fres {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		got = append(got, string(res.Message))
+	}
+
+	if len(got) != 2 || got[0] != "hello" || got[1] != "there" {
+		t.Error("Expected hello and there. got", got)
+	}
+
+	if b.Accepted() < 2 {
+		t.Error("Expected a second connection. got", b.Accepted())
+	}
+}
+
+func TestReconnectReplaysInFlight(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	end := b.Produce("foo", 0, []byte("hello"))
+
+	// The first fetch and offsets requests lose their connection
+	droppedFetch, droppedOffsets := false, false
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		switch {
+		case req.Type == kafkatest.RequestTypeMultiFetch && !droppedFetch:
+			droppedFetch = true
+			return kafkatest.Fault{Drop: true}
+		case req.Type == kafkatest.RequestTypeOffsets && !droppedOffsets:
+			droppedOffsets = true
+			return kafkatest.Fault{Truncate: 7}
+		}
+		return kafkatest.Fault{}
+	})
+
+	r, err := DialReconnecting(b.Addr, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tp := TopicPartition{"foo", 0}
+	fres, err := r.MultiFetch(MultiFetchRequest{{TopicPartitionOffset{tp, 0}, 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-fres
+	if res.Err != nil || string(res.Message) != "hello" || res.Offset != Offset(end) {
+		t.Fatal("Expected hello. got", res)
+	}
+	if _, ok := <-fres; ok {
+		t.Error("Expected a single message")
+	}
+
+	ores, err := r.Offsets(OffsetsRequest{tp, OffsetTimeLatest, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := <-ores
+	if offsets.Err != nil || len(offsets.Offsets) != 1 || offsets.Offsets[0].Offset != Offset(end) {
+		t.Fatal("Expected the latest offset. got", offsets)
+	}
+
+	if b.Accepted() != 3 {
+		t.Error("Expected 3 connections. got", b.Accepted())
+	}
+}
+
+func TestReconnectMidMultiFetch(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	tp0 := TopicPartition{"foo", 0}
+	tp1 := TopicPartition{"foo", 1}
+	end0 := b.Produce("foo", 0, []byte("hello"))
+	end1 := b.Produce("foo", 1, []byte("there"))
+
+	// The first multifetch hangs after foo-0's messages and partway into
+	// foo-1's: the response length, error code, then for each partition its
+	// set length, error code and messages
+	stalled := false
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		if req.Type == kafkatest.RequestTypeMultiFetch && !stalled {
+			stalled = true
+			return kafkatest.Fault{Truncate: 4 + 2 + 4 + 2 + int(end0) + 4 + 2 + 2, Stall: time.Second}
+		}
+		return kafkatest.Fault{}
+	})
+
+	d := Dialer{IOTimeout: 50 * time.Millisecond}
+	r, err := d.DialReconnecting(b.Addr, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	fres, err := r.MultiFetch(MultiFetchRequest{{TopicPartitionOffset{tp0, 0}, 1024}, {TopicPartitionOffset{tp1, 0}, 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []FetchResponse
+	for res := range fres {
+		got = append(got, res)
+	}
+
+	expected := []FetchResponse{
+		{Message("hello"), TopicPartitionOffset{tp0, Offset(end0)}, nil},
+		{Message("there"), TopicPartitionOffset{tp1, Offset(end1)}, nil},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Error("Expected", expected, "got", got)
+	}
+	if b.Accepted() != 2 {
+		t.Error("Expected 2 connections. got", b.Accepted())
+	}
+}
+
+func TestReconnectClose(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	r, err := DialReconnecting(b.Addr, Backoff{Min: time.Millisecond, Max: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.Fetch(FetchRequest{TopicPartitionOffset{TopicPartition{"foo", 0}, 0}, 1024}); err != ErrClosed {
+		t.Error("Expected ErrClosed. got", err)
+	}
+
+	if err = r.Produce(&ProduceRequest{TopicPartition: TopicPartition{"foo", 0}}); err != ErrClosed {
+		t.Error("Expected ErrClosed. got", err)
+	}
+}
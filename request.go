@@ -22,20 +22,71 @@ const (
 	requestTypeOffsets      requestType = 4
 )
 
+var requestTypeNames = map[requestType]string{
+	requestTypeProduce:      "produce",
+	requestTypeFetch:        "fetch",
+	requestTypeMultiFetch:   "multifetch",
+	requestTypeMultiProduce: "multiproduce",
+	requestTypeOffsets:      "offsets",
+}
+
+func (t requestType) String() string {
+	if name, ok := requestTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("request type %d", int16(t))
+}
+
 func (m Message) Len() int32 {
 	return int32(messageFullHeaderSize + len(m))
 }
 
 func (m Message) WriteTo(w io.Writer) (n int64, err error) {
-	compression := CompressionTypeNone
-	if compression != CompressionTypeNone {
-		return -1, fmt.Errorf("Only support none compression for now")
+	return writeMessage(w, CompressionTypeNone, m)
+}
+
+// Writes payload as a single message with the given compression attribute
+func writeMessage(w io.Writer, compression CompressionType, payload []byte) (n int64, err error) {
+	totalLen := Message(payload).Len() - 4 // Subtract the size of the length
+	checksum := uint32(crc32.Checksum(payload, crc32.IEEETable))
+
+	return binwrite(w, totalLen, MagicTypeWithCompression, compression, checksum, payload)
+}
+
+// Messages written in the magic 0 format, which has no compression attribute
+type legacyMessages Messages
+
+func (ms legacyMessages) Len() int32 {
+	l := int32(0)
+	for _, m := range ms {
+		l += int32(4 + legacyMessageHeaderSize + len(m))
 	}
+	// Add 4 for the length overhead
+	return l + 4
+}
 
-	totalLen := m.Len() - 4 // Subtract the size of the length
-	checksum := uint32(crc32.Checksum(m, crc32.IEEETable))
+func (ms legacyMessages) WriteTo(w io.Writer) (n int64, err error) {
+	if n, err = binwrite(w, ms.Len()-4); err != nil {
+		return -1, err
+	}
+	for _, m := range ms {
+		totalLen := int32(legacyMessageHeaderSize + len(m))
+		checksum := uint32(crc32.Checksum(m, crc32.IEEETable))
+
+		var nn int64
+		if nn, err = binwrite(w, totalLen, MagicTypeWithoutCompression, checksum, m); err != nil {
+			return -1, err
+		}
+		n += nn
+	}
+
+	return
+}
 
-	return binwrite(w, totalLen, MagicTypeWithCompression, compression, checksum, m)
+// What gets written on the wire for a produce request's messages
+type messageSet interface {
+	io.WriterTo
+	Len() int32
 }
 
 func (m Messages) Len() int32 {
@@ -156,13 +207,88 @@ func (MultiFetchRequest) Type() requestType {
 type ProduceRequest struct {
 	TopicPartition
 	Messages Messages
+
+	// If not CompressionTypeNone, Messages are sent as a single wrapper
+	// message whose payload is their compressed message set.  When sent
+	// through a SimpleConsumer, CompressionTypeNone falls back to the
+	// consumer's default compression and CompressionTypeForceNone sends
+	// them uncompressed regardless.
+	Compression CompressionType
+
+	// Write Messages in the magic 0 format for old brokers.  Legacy
+	// messages can't be compressed.
+	LegacyFormat bool
+
+	// Compressed payload of Messages.  Only filled in on the private copies
+	// made by prepare so we don't compress twice for Len and WriteTo.
+	wrapped Message
+}
+
+var errLegacyCompression = fmt.Errorf("Messages in the legacy format can't be compressed")
+
+// Returns the request that should actually be written, with the consumer's
+// defaults filled in and the wrapper payload computed up front
+func (req *ProduceRequest) prepare(compression CompressionType, legacy bool) (*ProduceRequest, error) {
+	r := *req
+	r.LegacyFormat = r.LegacyFormat || legacy
+	switch {
+	case r.Compression == CompressionTypeForceNone:
+		r.Compression = CompressionTypeNone
+	case r.Compression == CompressionTypeNone && !r.LegacyFormat:
+		r.Compression = compression
+	}
+
+	switch {
+	case r.LegacyFormat && r.Compression != CompressionTypeNone:
+		return nil, errLegacyCompression
+	case r.Compression == CompressionTypeNone:
+		return &r, nil
+	}
+
+	var err error
+	if r.wrapped, err = compressMessages(r.Compression, r.Messages); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (req *ProduceRequest) messageSet() (messageSet, error) {
+	uncompressed := req.Compression == CompressionTypeNone || req.Compression == CompressionTypeForceNone
+	switch {
+	case req.LegacyFormat && !uncompressed:
+		return nil, errLegacyCompression
+	case req.LegacyFormat:
+		return legacyMessages(req.Messages), nil
+	case uncompressed:
+		return req.Messages, nil
+	}
+
+	payload := req.wrapped
+	if payload == nil {
+		var err error
+		if payload, err = compressMessages(req.Compression, req.Messages); err != nil {
+			return nil, err
+		}
+	}
+
+	return &wrappedMessages{req.Compression, payload}, nil
 }
 
 func (req *ProduceRequest) Len() int32 {
-	return int32(2+len([]byte(req.Topic))+4) + req.Messages.Len() // topiclen, topic, partition, messageslen + messages
+	ms, err := req.messageSet()
+	if err != nil {
+		// WriteTo will fail with the same error
+		ms = req.Messages
+	}
+	return int32(2+len([]byte(req.Topic))+4) + ms.Len() // topiclen, topic, partition, messageslen + messages
 }
 
 func (req *ProduceRequest) WriteTo(w io.Writer) (n int64, err error) {
+	ms, err := req.messageSet()
+	if err != nil {
+		return -1, err
+	}
+
 	if n, err = writeTopic(w, req.Topic); err != nil {
 		return -1, err
 	}
@@ -173,7 +299,7 @@ func (req *ProduceRequest) WriteTo(w io.Writer) (n int64, err error) {
 	}
 	n += nn
 
-	if nn, err = req.Messages.WriteTo(w); err != nil {
+	if nn, err = ms.WriteTo(w); err != nil {
 		return -1, err
 	}
 	n += nn
@@ -186,6 +312,18 @@ func (m *ProduceRequest) Type() requestType {
 
 type MultiProduceRequest []ProduceRequest
 
+func (reqs MultiProduceRequest) prepare(compression CompressionType, legacy bool) (MultiProduceRequest, error) {
+	prepared := make(MultiProduceRequest, len(reqs))
+	for i := range reqs {
+		r, err := reqs[i].prepare(compression, legacy)
+		if err != nil {
+			return nil, err
+		}
+		prepared[i] = *r
+	}
+	return prepared, nil
+}
+
 func (reqs MultiProduceRequest) WriteTo(w io.Writer) (n int64, err error) {
 	cnt := int16(len(reqs))
 
@@ -2,6 +2,8 @@ package kafka
 
 import (
 	"bytes"
+	"compress/gzip"
+	"io/ioutil"
 	"testing"
 )
 
@@ -109,3 +111,196 @@ func TestMultiProduce(t *testing.T) {
 		t.Error("Written and  bufferlength are not the same. wrote:", written, "expected:", buff.Len())
 	}
 }
+
+func TestProduceGZip(t *testing.T) {
+	buff := bytes.NewBuffer(make([]byte, 0, 256))
+
+	tp := TopicPartition{"foo", 0}
+	pr := ProduceRequest{
+		TopicPartition: tp,
+		Messages: Messages{
+			[]byte("hello"),
+			[]byte("there"),
+		},
+		Compression: CompressionTypeGZip,
+	}
+
+	written, err := pr.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if written != int64(pr.Len()) {
+		t.Error("Written and length are not the same. wrote:", written, "expected:", pr.Len())
+	}
+
+	if written != int64(buff.Len()) {
+		t.Error("Written and  bufferlength are not the same. wrote:", written, "expected:", buff.Len())
+	}
+
+	var topicLen int16
+	var partition Partition
+	var setLen, msgLen int32
+	var magic MagicType
+	var compression CompressionType
+	var checksum uint32
+	if err = binread(buff, &topicLen, make([]byte, 3), &partition, &setLen, &msgLen, &magic, &compression, &checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	if magic != MagicTypeWithCompression || compression != CompressionTypeGZip {
+		t.Fatal("Expected a gzip wrapper message. got magic:", magic, "compression:", compression)
+	}
+
+	zr, err := gzip.NewReader(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := bytes.NewBuffer(nil)
+	if err = writeMessageSet(expected, pr.Messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(inner, expected.Bytes()) {
+		t.Error("Decompressed message set does not match. got:", inner, "expected:", expected.Bytes())
+	}
+}
+
+func TestMultiProducePrepare(t *testing.T) {
+	buff := bytes.NewBuffer(make([]byte, 0, 256))
+
+	pr := MultiProduceRequest{
+		ProduceRequest{
+			TopicPartition: TopicPartition{"foo", 0},
+			Messages:       Messages{[]byte("hello")},
+		},
+		ProduceRequest{
+			TopicPartition: TopicPartition{"bar", 0},
+			Messages:       Messages{[]byte("there")},
+			Compression:    CompressionTypeGZip,
+		},
+	}
+
+	prepared, err := pr.prepare(CompressionTypeGZip, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range prepared {
+		if prepared[i].Compression != CompressionTypeGZip || prepared[i].wrapped == nil {
+			t.Error("Request", i, "was not compressed")
+		}
+	}
+
+	if pr[0].Compression != CompressionTypeNone {
+		t.Error("prepare modified the original request")
+	}
+
+	written, err := prepared.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if written != int64(prepared.Len()) {
+		t.Error("Written and length are not the same. wrote:", written, "expected:", prepared.Len())
+	}
+}
+
+func TestProduceForceNone(t *testing.T) {
+	pr := MultiProduceRequest{
+		ProduceRequest{
+			TopicPartition: TopicPartition{"foo", 0},
+			Messages:       Messages{[]byte("hello")},
+			Compression:    CompressionTypeForceNone,
+		},
+		ProduceRequest{
+			TopicPartition: TopicPartition{"bar", 0},
+			Messages:       Messages{[]byte("there")},
+		},
+	}
+
+	prepared, err := pr.prepare(CompressionTypeGZip, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prepared[0].Compression != CompressionTypeNone || prepared[0].wrapped != nil {
+		t.Error("Expected the request to override the default. got", prepared[0].Compression)
+	}
+	if prepared[1].Compression != CompressionTypeGZip {
+		t.Error("Expected the default for the other request. got", prepared[1].Compression)
+	}
+
+	buff := bytes.NewBuffer(make([]byte, 0, 256))
+	written, err := prepared[:1].WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(prepared[:1].Len()) {
+		t.Error("Written and length are not the same. wrote:", written, "expected:", prepared[:1].Len())
+	}
+
+	var count, topicLen int16
+	var partition Partition
+	var setLen, msgLen int32
+	var magic MagicType
+	var compression CompressionType
+	if err = binread(buff, &count, &topicLen, make([]byte, 3), &partition, &setLen, &msgLen, &magic, &compression); err != nil {
+		t.Fatal(err)
+	}
+	if magic != MagicTypeWithCompression || compression != CompressionTypeNone {
+		t.Error("Expected an uncompressed message. got magic:", magic, "compression:", compression)
+	}
+}
+
+func TestProduceLegacyFormat(t *testing.T) {
+	buff := bytes.NewBuffer(make([]byte, 0, 256))
+
+	pr := ProduceRequest{
+		TopicPartition: TopicPartition{"foo", 0},
+		Messages: Messages{
+			[]byte("hello"),
+			[]byte("there"),
+		},
+		LegacyFormat: true,
+	}
+
+	written, err := pr.WriteTo(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if written != int64(pr.Len()) {
+		t.Error("Written and length are not the same. wrote:", written, "expected:", pr.Len())
+	}
+
+	if written != int64(buff.Len()) {
+		t.Error("Written and  bufferlength are not the same. wrote:", written, "expected:", buff.Len())
+	}
+
+	var topicLen int16
+	var partition Partition
+	var setLen, msgLen int32
+	var magic MagicType
+	if err = binread(buff, &topicLen, make([]byte, 3), &partition, &setLen, &msgLen, &magic); err != nil {
+		t.Fatal(err)
+	}
+
+	if magic != MagicTypeWithoutCompression || msgLen != legacyMessageHeaderSize+5 {
+		t.Error("Expected a magic 0 message. got magic:", magic, "length:", msgLen)
+	}
+
+	if _, err = pr.prepare(CompressionTypeGZip, false); err != nil {
+		t.Error("Default compression should not apply to legacy requests:", err)
+	}
+
+	pr.Compression = CompressionTypeGZip
+	if _, err = pr.prepare(CompressionTypeNone, false); err == nil {
+		t.Error("Expected an error compressing legacy messages")
+	}
+}
@@ -1,8 +1,11 @@
 package kafka
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
+	"sync"
 )
 
 // Can return either an error or a message
@@ -16,6 +19,24 @@ type FetchResponse struct {
 
 type FetchResponseChan chan FetchResponse
 
+// Sent in place of messages when a fetch's MaxSize can't hold the first
+// message at the requested offset.  Retry with a MaxSize of at least
+// MessageSize.
+type FetchSizeError struct {
+	TopicPartitionOffset
+
+	// Size of the message including its length, or 0 if the broker didn't
+	// send enough to tell
+	MessageSize int32
+}
+
+func (e *FetchSizeError) Error() string {
+	if e.MessageSize == 0 {
+		return fmt.Sprintf("%s (%s:%d at offset %d)", ErrorCodeInvalidFetchSize, e.Topic, e.Partition, e.Offset)
+	}
+	return fmt.Sprintf("%s (%s:%d at offset %d needs %d bytes)", ErrorCodeInvalidFetchSize, e.Topic, e.Partition, e.Offset, e.MessageSize)
+}
+
 type OffsetsResponse struct {
 	// Add the topic and partition with it to make things easier
 	Offsets []TopicPartitionOffset
@@ -32,18 +53,169 @@ type responseJob interface {
 	ReadResponse(r io.Reader, c *SimpleConsumer) (err error)
 }
 
+// Delivers fetch results to the caller.  If the caller's context is done
+// first the channel is closed early and whatever the read worker still
+// reads for the job is dropped.  Results are also dropped once the
+// connection stops, so a caller that isn't reading can't hold up the read
+// worker.
+type fetchSink struct {
+	ctx context.Context
+	// The connection's done channel
+	done <-chan struct{}
+	ch   FetchResponseChan
+	stop func() bool
+	// Closed by Close, to let go of a send that's still waiting
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newFetchSink(ctx context.Context, done <-chan struct{}) *fetchSink {
+	s := &fetchSink{ctx: ctx, done: done, ch: make(FetchResponseChan), quit: make(chan struct{})}
+	s.stop = context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if !s.closed {
+			// Only a receiver that's already waiting gets told why
+			select {
+			case s.ch <- FetchResponse{Err: ctx.Err()}:
+			default:
+			}
+			s.closed = true
+			close(s.ch)
+		}
+	})
+	return s
+}
+
+func (s *fetchSink) send(res FetchResponse) {
+	s.deliver(res, s.done)
+}
+
+// Returns false if done was closed before res could be delivered
+func (s *fetchSink) deliver(res FetchResponse, done <-chan struct{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return true
+	}
+	select {
+	case s.ch <- res:
+	case <-s.ctx.Done():
+	case <-s.quit:
+	case <-done:
+		return false
+	}
+	return true
+}
+
+func (s *fetchSink) Close() {
+	s.quitOnce.Do(func() { close(s.quit) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.stop()
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+// The caller still gets err after the connection has stopped, but without
+// the read worker waiting for them to read it
+func (s *fetchSink) Fail(err error) {
+	res := FetchResponse{Err: err}
+	if !s.deliver(res, s.done) {
+		go func() {
+			s.deliver(res, nil)
+			s.Close()
+		}()
+		return
+	}
+	s.Close()
+}
+
+// Same as fetchSink for the single offsets response
 type offsetsResponseJob struct {
 	TopicPartition
-	ch chan OffsetsResponse
+	ctx      context.Context
+	done     <-chan struct{}
+	ch       chan OffsetsResponse
+	stop     func() bool
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newOffsetsResponseJob(ctx context.Context, done <-chan struct{}, tp TopicPartition) *offsetsResponseJob {
+	j := &offsetsResponseJob{TopicPartition: tp, ctx: ctx, done: done, ch: make(chan OffsetsResponse), quit: make(chan struct{})}
+	j.stop = context.AfterFunc(ctx, func() {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+
+		if !j.closed {
+			select {
+			case j.ch <- OffsetsResponse{Err: ctx.Err()}:
+			default:
+			}
+			j.closed = true
+			close(j.ch)
+		}
+	})
+	return j
+}
+
+func (j *offsetsResponseJob) send(res OffsetsResponse) {
+	j.deliver(res, j.done)
+}
+
+func (j *offsetsResponseJob) deliver(res OffsetsResponse, done <-chan struct{}) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return true
+	}
+	select {
+	case j.ch <- res:
+	case <-j.ctx.Done():
+	case <-j.quit:
+	case <-done:
+		return false
+	}
+	return true
 }
 
 func (j *offsetsResponseJob) Close() {
-	close(j.ch)
+	j.quitOnce.Do(func() { close(j.quit) })
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.closed {
+		j.stop()
+		j.closed = true
+		close(j.ch)
+	}
 }
 
 func (j *offsetsResponseJob) Fail(err error) {
-	j.ch <- OffsetsResponse{Err: err}
-	close(j.ch)
+	res := OffsetsResponse{Err: err}
+	if !j.deliver(res, j.done) {
+		go func() {
+			j.deliver(res, nil)
+			j.Close()
+		}()
+		return
+	}
+	j.Close()
 }
 
 func (j *offsetsResponseJob) ReadResponse(r io.Reader, c *SimpleConsumer) (err error) {
@@ -63,41 +235,23 @@ func (j *offsetsResponseJob) ReadResponse(r io.Reader, c *SimpleConsumer) (err e
 		offsets[i].TopicPartition = j.TopicPartition
 	}
 
-	j.ch <- OffsetsResponse{Offsets: offsets}
+	j.send(OffsetsResponse{Offsets: offsets})
 
 	return
 }
 
 type fetchResponseJob struct {
 	TopicPartitionOffset
-	ch FetchResponseChan
-}
-
-func (j *fetchResponseJob) Close() {
-	close(j.ch)
-}
-
-func (j *fetchResponseJob) Fail(err error) {
-	j.ch <- FetchResponse{Err: err}
-	close(j.ch)
+	*fetchSink
 }
 
 func (j *fetchResponseJob) ReadResponse(r io.Reader, c *SimpleConsumer) (err error) {
-	return c.readMessagesSet(j.TopicPartitionOffset, j.ch, r)
+	return c.readMessagesSet(j.TopicPartitionOffset, j.fetchSink, r)
 }
 
 type multiFetchResponseJob struct {
 	mfr MultiFetchRequest
-	ch  FetchResponseChan
-}
-
-func (j *multiFetchResponseJob) Close() {
-	close(j.ch)
-}
-
-func (j *multiFetchResponseJob) Fail(err error) {
-	j.ch <- FetchResponse{Err: err}
-	close(j.ch)
+	*fetchSink
 }
 
 func (j *multiFetchResponseJob) ReadResponse(r io.Reader, c *SimpleConsumer) (err error) {
@@ -111,17 +265,28 @@ func (j *multiFetchResponseJob) ReadResponse(r io.Reader, c *SimpleConsumer) (er
 			return
 		}
 
-		messageSetReader := io.LimitReader(r, int64(messageSetLen))
+		messageSetReader := io.LimitReader(r, int64(messageSetLen)).(*io.LimitedReader)
 		var code ErrorCode
-		switch err = binread(messageSetReader, &code); {
-		case err != nil :
+		if err = binread(messageSetReader, &code); err != nil {
 			return err
-		case code != ErrorCodeNoError:
-			return code
 		}
 
-		err = c.readMessagesSet(info.TopicPartitionOffset, j.ch, messageSetReader)
+		// Errors only fail their own partition, as long as we can still
+		// find where the next one starts.  Otherwise the connection is
+		// gone and the whole request fails with it.
+		var partErr error
+		if code != ErrorCodeNoError {
+			partErr = code
+		} else {
+			partErr = c.readMessagesSet(info.TopicPartitionOffset, j.fetchSink, messageSetReader)
+		}
+
+		if err = discardResponse(messageSetReader); err != nil {
+			return
+		}
+		if partErr != nil {
+			j.send(FetchResponse{TopicPartitionOffset: info.TopicPartitionOffset, Err: partErr})
+		}
 	}
 	return
 }
-
@@ -0,0 +1,272 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// A small implementation of the snappy block format
+// (https://github.com/google/snappy/blob/master/format_description.txt)
+// along with the stream framing snappy-java uses, which is what the JVM
+// producers put inside snappy wrapper messages.
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	// Offsets inside a block fit in 2 bytes as long as blocks stay this size
+	snappyMaxBlockSize = 65536
+
+	snappyTableBits = 14
+	snappyTableSize = 1 << snappyTableBits
+
+	// snappy-java's SnappyOutputStream default
+	xerialBlockSize = 32 * 1024
+)
+
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+var errSnappyCorrupt = fmt.Errorf("Corrupt snappy input")
+
+// Registered for CompressionTypeSnappy
+type snappyCodec struct{}
+
+func (snappyCodec) Compress(messageSet []byte) ([]byte, error) {
+	return xerialEncode(messageSet), nil
+}
+
+func (snappyCodec) Decompress(payload []byte) ([]byte, error) {
+	return xerialDecode(payload)
+}
+
+// Encodes src as a single snappy block
+func snappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/6)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	for len(src) > 0 {
+		p := src
+		if len(p) > snappyMaxBlockSize {
+			p = p[:snappyMaxBlockSize]
+		}
+		dst = snappyEncodeBlock(dst, p)
+		src = src[len(p):]
+	}
+	return dst
+}
+
+func snappyLoad32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
+
+func snappyHash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+// Greedy matcher: look up the last position with the same 4 bytes and
+// extend the match as far as it goes
+func snappyEncodeBlock(dst, src []byte) []byte {
+	if len(src) < 4 {
+		return snappyEmitLiteral(dst, src)
+	}
+
+	var table [snappyTableSize]int32
+	lit := 0
+	for s := 0; s+4 <= len(src); {
+		cur := snappyLoad32(src, s)
+		h := snappyHash(cur)
+		cand := int(table[h])
+		table[h] = int32(s)
+
+		if cand >= s || snappyLoad32(src, cand) != cur {
+			s++
+			continue
+		}
+
+		dst = snappyEmitLiteral(dst, src[lit:s])
+
+		length := 4
+		for s+length < len(src) && src[cand+length] == src[s+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, s-cand, length)
+
+		s += length
+		lit = s
+	}
+
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// length is at least 4 and offset fits in 2 bytes
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, (64-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, (60-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+// Decodes a single snappy block
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > 0xffffffff {
+		return nil, errSnappyCorrupt
+	}
+
+	// Each byte of input can expand to at most 64 bytes (a 1 byte tag
+	// copying 64) so don't trust a wildly larger header
+	if n > uint64(len(src))*64 {
+		return nil, errSnappyCorrupt
+	}
+
+	dst := make([]byte, 0, int(n))
+	for s := k; s < len(src); {
+		var length, offset int
+
+		tag := src[s]
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			x := uint32(tag >> 2)
+			s++
+			if x >= 60 {
+				extra := int(x - 59)
+				if s+extra > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				x = 0
+				for i := extra - 1; i >= 0; i-- {
+					x = x<<8 | uint32(src[s+i])
+				}
+				s += extra
+			}
+			length = int(x) + 1
+			if length <= 0 || s+length > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+
+		case snappyTagCopy1:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[s+1])
+			s += 2
+
+		case snappyTagCopy2:
+			if s+3 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+
+		case snappyTagCopy4:
+			if s+5 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap their own output so go byte by byte
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
+
+// Compresses src the way snappy-java's SnappyOutputStream does: a header
+// followed by length prefixed snappy blocks
+func xerialEncode(src []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(xerialHeader)
+	binwrite(&buf, int32(1), int32(1)) // version, minimum compatible version
+
+	for len(src) > 0 {
+		p := src
+		if len(p) > xerialBlockSize {
+			p = p[:xerialBlockSize]
+		}
+		block := snappyEncode(p)
+		binwrite(&buf, int32(len(block)), block)
+		src = src[len(p):]
+	}
+	return buf.Bytes()
+}
+
+// Decodes either snappy-java stream framing or a bare snappy block
+func xerialDecode(src []byte) ([]byte, error) {
+	if !bytes.HasPrefix(src, xerialHeader) {
+		return snappyDecode(src)
+	}
+
+	// Skip the header and the two version fields
+	if len(src) < len(xerialHeader)+8 {
+		return nil, errSnappyCorrupt
+	}
+	src = src[len(xerialHeader)+8:]
+
+	var dst []byte
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, errSnappyCorrupt
+		}
+		blockLen := int(networkOrder.Uint32(src))
+		src = src[4:]
+		if blockLen < 0 || blockLen > len(src) {
+			return nil, errSnappyCorrupt
+		}
+
+		block, err := snappyDecode(src[:blockLen])
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, block...)
+		src = src[blockLen:]
+	}
+	return dst, nil
+}
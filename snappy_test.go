@@ -0,0 +1,68 @@
+package kafka
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSnappyDecode(t *testing.T) {
+	cases := []struct {
+		encoded  []byte
+		expected string
+	}{
+		{[]byte("\x05\x10hello"), "hello"},
+		// literal "ab" followed by an overlapping copy of 8 at offset 2
+		{[]byte("\x0a\x04ab\x11\x02"), "ababababab"},
+	}
+
+	for _, c := range cases {
+		decoded, err := snappyDecode(c.encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != c.expected {
+			t.Error("Expected", c.expected, "got", string(decoded))
+		}
+	}
+
+	if _, err := snappyDecode([]byte("\x0a\x04ab\x11\x05")); err == nil {
+		t.Error("Expected an error for a copy from before the start of the output")
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := [][]byte{
+		{},
+		[]byte("abc"),
+		[]byte("hello there, hello there, hello there"),
+		bytes.Repeat([]byte("kafka"), 30000),
+		random,
+	}
+
+	for _, in := range inputs {
+		decoded, err := snappyDecode(snappyEncode(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(in, decoded) {
+			t.Error("Block round trip failed for input of length", len(in))
+		}
+
+		decoded, err = xerialDecode(xerialEncode(in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(in, decoded) {
+			t.Error("Stream round trip failed for input of length", len(in))
+		}
+	}
+
+	repetitive := bytes.Repeat([]byte("kafka"), 30000)
+	if l := len(snappyEncode(repetitive)); l > len(repetitive)/10 {
+		t.Error("Repetitive input did not compress. got", l, "bytes")
+	}
+}
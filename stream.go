@@ -1,20 +1,155 @@
 package kafka
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
 	"time"
 )
 
 type topicPartitionOffsetMap map[string]map[Partition]Offset
 
 // These are slightly different than the java api.  They encompass multiple topics
+//
+// The stream polls until Close is called or it hits an error, which is sent
+// on Ch before Ch is closed.
 type KafkaStream struct {
 	offsets topicPartitionOffsetMap
 	c       *SimpleConsumer
 	Ch      FetchResponseChan
+	config  StreamConfig
+
+	// Sends a result somewhere other than Ch when set.  Returns false if
+	// ctx was done first, in which case the offsets don't move.
+	deliver func(ctx context.Context, res FetchResponse) bool
+
+	// Empty polls in a row, which the wait before the next one grows with
+	idle int
+
+	// Partitions whose next message didn't fit in their configured fetch
+	// size.  Dropped once a message arrives, so one large message doesn't
+	// make every later fetch large.
+	fetchSizes map[TopicPartition]int32
+
+	// When offsets were last committed to config.Store
+	lastCommit time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Closed once polling has stopped and Ch is closed
+	done chan struct{}
+	// Set before done is closed
+	final []TopicPartitionOffset
+	err   error
+
+	// Add and Remove calls waiting for the next poll
+	changeLock sync.Mutex
+	changes    []streamChange
+	// Cuts the wait short when there are changes
+	wake chan struct{}
+}
+
+type StreamConfig struct {
+	// Largest fetch per partition, grown when a message doesn't fit.
+	// defaultFetchSize if 0.
+	FetchSize int32
+	// Per topic overrides of FetchSize
+	TopicFetchSizes map[string]int32
+
+	// How long to wait after a poll that got nothing.  The wait doubles
+	// with every empty poll in a row up to MaxPollInterval, and a poll that
+	// got messages is followed by the next one right away.  pollTime if 0.
+	MinPollInterval time.Duration
+	// 1 second if 0
+	MaxPollInterval time.Duration
+
+	// What to do when the broker no longer has a partition's offset,
+	// usually because retention deleted it.  OffsetResetFail if 0.
+	OffsetReset OffsetReset
+	// Called from the poll loop when a partition is moved from an offset
+	// that was out of range.  May be nil.
+	OnOffsetReset func(tp TopicPartition, from, to Offset)
+
+	// Where to commit offsets, every CommitInterval and when the stream
+	// stops.  Streams started at an OffsetTime start partitions that have
+	// an offset in Store from it instead.  May be nil.
+	Store OffsetStore
+	// 10 seconds if 0
+	CommitInterval time.Duration
+}
+
+const defaultMaxPollInterval = time.Second
+
+type OffsetReset int
+
+const (
+	// Send ErrorCodeOffsetOutOfRange on Ch and stop
+	OffsetResetFail OffsetReset = iota
+	// Move to the oldest offset the broker has
+	OffsetResetEarliest
+	// Move to the end, skipping everything the broker has
+	OffsetResetLatest
+)
+
+type streamChange struct {
+	TopicPartitionOffset
+	remove bool
 }
 
 func NewKafkaStreamWithOffsets(c *SimpleConsumer, targets []TopicPartition, startTime OffsetTime) (s *KafkaStream, err error) {
-	newT := make([]TopicPartitionOffset, len(targets))
+	return NewKafkaStreamAt(context.Background(), c, targets, startTime, StreamConfig{})
+}
+
+// Like NewKafkaStreamWithOffsets, but partitions with an offset in store
+// start from it.  The stream commits its offsets to store every
+// 10 seconds and when it stops.
+func NewKafkaStreamWithStore(c *SimpleConsumer, targets []TopicPartition, startTime OffsetTime, store OffsetStore) (s *KafkaStream, err error) {
+	return NewKafkaStreamAt(context.Background(), c, targets, startTime, StreamConfig{Store: store})
+}
+
+// Like NewKafkaStreamWithConfig, but starts each target at startTime, or
+// at its offset in config.Store if it has one
+func NewKafkaStreamAt(ctx context.Context, c *SimpleConsumer, targets []TopicPartition, startTime OffsetTime, config StreamConfig) (s *KafkaStream, err error) {
+	newT, err := storedOffsets(c, targets, startTime, config.Store)
+	if err != nil {
+		return nil, err
+	}
+	return NewKafkaStreamWithConfig(ctx, c, newT, config)
+}
+
+// Where each target starts: its offset in store if it has one, otherwise
+// its offset at startTime
+func storedOffsets(c *SimpleConsumer, targets []TopicPartition, startTime OffsetTime, store OffsetStore) (newT []TopicPartitionOffset, err error) {
+	if store == nil {
+		return startOffsets(c, targets, startTime)
+	}
+
+	saved, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []TopicPartition
+	for _, tp := range targets {
+		if o, ok := saved[tp]; ok {
+			newT = append(newT, TopicPartitionOffset{tp, o})
+		} else {
+			missing = append(missing, tp)
+		}
+	}
+
+	fresh, err := startOffsets(c, missing, startTime)
+	if err != nil {
+		return nil, err
+	}
+	return append(newT, fresh...), nil
+}
+
+// Asks the broker for the offset at startTime of each target
+func startOffsets(c *SimpleConsumer, targets []TopicPartition, startTime OffsetTime) (newT []TopicPartitionOffset, err error) {
+	newT = make([]TopicPartitionOffset, len(targets))
 	offReq := OffsetsRequest{
 		Time:      startTime,
 		MaxNumber: 1,
@@ -41,7 +176,7 @@ func NewKafkaStreamWithOffsets(c *SimpleConsumer, targets []TopicPartition, star
 		newT[i] = offRes.Offsets[0]
 	}
 
-	return NewKafkaStream(c, newT)
+	return newT, nil
 }
 
 func (s *KafkaStream) partCount() (i int) {
@@ -53,43 +188,300 @@ func (s *KafkaStream) partCount() (i int) {
 
 const pollTime time.Duration = 50 * time.Millisecond
 
+const defaultFetchSize = 1024 * 1024
+
 func (s *KafkaStream) poll() (err error) {
-	a := time.After(pollTime)
+	s.applyChanges()
+	if s.partCount() == 0 {
+		return s.wait(false)
+	}
 
 	mfr := make(MultiFetchRequest, 0, s.partCount())
 	fr := FetchRequest{}
-	fr.MaxSize = 1024 * 1024
 	var pm map[Partition]Offset
 	for fr.Topic, pm = range s.offsets {
 		for fr.Partition, fr.Offset = range pm {
+			fr.MaxSize = s.fetchSize(fr.TopicPartition)
 			mfr = append(mfr, fr)
 		}
 	}
 
-	resChan, err := s.c.MultiFetch(mfr)
+	resChan, err := s.c.MultiFetchContext(s.ctx, mfr)
 	if err != nil {
+		s.send(FetchResponse{Err: err})
 		return err
 	}
 
+	// Whatever is left of the response once we stop reading it.  The
+	// channel closes early if we were cancelled.
+	defer func() {
+		for range resChan {
+		}
+	}()
+
+	got := false
+	var outOfRange []TopicPartitionOffset
 	for res := range resChan {
-		s.Ch <- res
+		if fse, ok := res.Err.(*FetchSizeError); ok {
+			s.growFetchSize(fse)
+			got = true
+			continue
+		}
+		if res.Err == ErrorCodeOffsetOutOfRange && s.config.OffsetReset != OffsetResetFail {
+			outOfRange = append(outOfRange, res.TopicPartitionOffset)
+			got = true
+			continue
+		}
+
+		if !s.send(res) {
+			return s.ctx.Err()
+		}
 		if res.Err != nil {
-			close(s.Ch)
 			return res.Err
 		}
 		s.updatePartitionMap(res.TopicPartitionOffset)
+		delete(s.fetchSizes, res.TopicPartition)
+		got = true
 	}
 
-	<-a
-	return
+	if len(outOfRange) > 0 {
+		if err = s.resetOffsets(outOfRange); err != nil {
+			s.send(FetchResponse{Err: err})
+			return err
+		}
+	}
+
+	return s.wait(got)
+}
+
+// Moves each partition to where the reset policy says.  The offsets
+// requests can't go out until the fetch response is read, since they'd
+// queue up behind it.
+func (s *KafkaStream) resetOffsets(outOfRange []TopicPartitionOffset) (err error) {
+	offReq := OffsetsRequest{
+		Time:      OffsetTimeEarliest,
+		MaxNumber: 1,
+	}
+	if s.config.OffsetReset == OffsetResetLatest {
+		offReq.Time = OffsetTimeLatest
+	}
+
+	resChans := make([]OffsetsResponseChan, len(outOfRange))
+	for i, o := range outOfRange {
+		offReq.TopicPartition = o.TopicPartition
+		if resChans[i], err = s.c.OffsetsContext(s.ctx, offReq); err != nil {
+			resChans = resChans[:i]
+			break
+		}
+	}
+
+	// Read every response even after one fails so none are left blocked
+	for i, offC := range resChans {
+		offRes := <-offC
+		switch {
+		case err != nil:
+		case s.ctx.Err() != nil:
+			// The channel was closed early
+			err = s.ctx.Err()
+		case offRes.Err != nil:
+			err = offRes.Err
+		case len(offRes.Offsets) == 0:
+			err = fmt.Errorf("No offsets for partition %d of %s", outOfRange[i].Partition, outOfRange[i].Topic)
+		default:
+			to := offRes.Offsets[0].Offset
+			s.updatePartitionMap(TopicPartitionOffset{outOfRange[i].TopicPartition, to})
+			if s.config.OnOffsetReset != nil {
+				s.config.OnOffsetReset(outOfRange[i].TopicPartition, outOfRange[i].Offset, to)
+			}
+		}
+	}
+	return err
+}
+
+// Waits before the next poll unless the last one got something
+func (s *KafkaStream) wait(got bool) error {
+	if got {
+		s.idle = 0
+		return nil
+	}
+
+	t := time.NewTimer(s.pollInterval())
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		s.idle++
+	case <-s.wake:
+		s.idle = 0
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	return nil
+}
+
+// Returns false if we were cancelled first.  Errors caused by the
+// cancellation aren't worth sending.
+func (s *KafkaStream) send(res FetchResponse) bool {
+	if s.ctx.Err() != nil {
+		return false
+	}
+	if s.deliver != nil {
+		return s.deliver(s.ctx, res)
+	}
+	select {
+	case s.Ch <- res:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
 }
 
 func (s *KafkaStream) pollLoop() (err error) {
+	defer func() {
+		s.applyChanges()
+		s.commit()
+		if s.ctx.Err() == nil {
+			s.err = err
+		}
+		s.final = s.offsetList()
+		close(s.Ch)
+		close(s.done)
+	}()
+
 	for ; err == nil; err = s.poll() {
+		if s.config.Store != nil && time.Since(s.lastCommit) >= s.config.CommitInterval {
+			s.commit()
+		}
 	}
 	return
 }
 
+// Stops polling, abandoning the fetch in flight, and closes Ch.  Returns the
+// offset after the last message sent on Ch for every partition, and the
+// error that stopped the stream if it stopped on its own first.
+func (s *KafkaStream) Close() (offsets []TopicPartitionOffset, err error) {
+	s.cancel()
+	<-s.done
+	return s.final, s.err
+}
+
+// Closed once the stream has stopped, by Close, its context or an error
+func (s *KafkaStream) Done() <-chan struct{} {
+	return s.done
+}
+
+// Starts reading a partition from o.Offset with the next poll.  If the
+// stream already reads the partition it moves to o.Offset instead.
+func (s *KafkaStream) Add(o TopicPartitionOffset) {
+	s.change(streamChange{TopicPartitionOffset: o})
+}
+
+// Stops reading a partition with the next poll.  Messages from a fetch
+// that's already in flight may still arrive on Ch.
+func (s *KafkaStream) Remove(tp TopicPartition) {
+	s.change(streamChange{TopicPartitionOffset: TopicPartitionOffset{TopicPartition: tp}, remove: true})
+}
+
+func (s *KafkaStream) change(c streamChange) {
+	s.changeLock.Lock()
+	defer s.changeLock.Unlock()
+	s.changes = append(s.changes, c)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Only called from the poll loop, which owns offsets and fetchSizes
+func (s *KafkaStream) applyChanges() {
+	s.changeLock.Lock()
+	changes := s.changes
+	s.changes = nil
+	s.changeLock.Unlock()
+
+	for _, c := range changes {
+		if !c.remove {
+			s.updatePartitionMap(c.TopicPartitionOffset)
+			continue
+		}
+
+		if pm := s.offsets[c.Topic]; pm != nil {
+			delete(pm, c.Partition)
+			if len(pm) == 0 {
+				delete(s.offsets, c.Topic)
+			}
+		}
+		delete(s.fetchSizes, c.TopicPartition)
+	}
+}
+
+// Every partition's offset, sorted
+func (s *KafkaStream) offsetList() []TopicPartitionOffset {
+	offsets := make([]TopicPartitionOffset, 0, s.partCount())
+	for topic, pm := range s.offsets {
+		for partition, offset := range pm {
+			offsets = append(offsets, TopicPartitionOffset{TopicPartition{topic, partition}, offset})
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		if offsets[i].Topic != offsets[j].Topic {
+			return offsets[i].Topic < offsets[j].Topic
+		}
+		return offsets[i].Partition < offsets[j].Partition
+	})
+	return offsets
+}
+
+// Saves the offset after the last message sent on Ch for every partition
+func (s *KafkaStream) commit() {
+	if s.config.Store == nil {
+		return
+	}
+	s.lastCommit = time.Now()
+
+	offsets := make(map[TopicPartition]Offset, s.partCount())
+	for _, o := range s.offsetList() {
+		offsets[o.TopicPartition] = o.Offset
+	}
+	if err := s.config.Store.Commit(offsets); err != nil {
+		log.Println("Committing stream offsets failed:", err)
+	}
+}
+
+// MinPollInterval * 2^idle, capped at MaxPollInterval
+func (s *KafkaStream) pollInterval() time.Duration {
+	d := s.config.MinPollInterval
+	for i := 0; i < s.idle && d < s.config.MaxPollInterval; i++ {
+		d *= 2
+	}
+	if d > s.config.MaxPollInterval {
+		d = s.config.MaxPollInterval
+	}
+	return d
+}
+
+func (s *KafkaStream) fetchSize(tp TopicPartition) int32 {
+	if size, ok := s.fetchSizes[tp]; ok {
+		return size
+	}
+	if size := s.config.TopicFetchSizes[tp.Topic]; size > 0 {
+		return size
+	}
+	return s.config.FetchSize
+}
+
+// Retry a partition whose next message was too big with enough room for it
+func (s *KafkaStream) growFetchSize(e *FetchSizeError) {
+	size := s.fetchSize(e.TopicPartition)
+	if e.MessageSize > size {
+		size = e.MessageSize
+	} else {
+		size *= 2
+	}
+	s.fetchSizes[e.TopicPartition] = size
+}
+
 func (s *KafkaStream) updatePartitionMap(offsets ...TopicPartitionOffset) {
 	for _, o := range offsets {
 		po := s.offsets[o.Topic]
@@ -103,12 +495,50 @@ func (s *KafkaStream) updatePartitionMap(offsets ...TopicPartitionOffset) {
 }
 
 func NewKafkaStream(c *SimpleConsumer, targets []TopicPartitionOffset) (s *KafkaStream, err error) {
-	s = &KafkaStream{
-		c:       c,
-		offsets: make(topicPartitionOffsetMap),
-		Ch:      make(FetchResponseChan),
-	}
-	s.updatePartitionMap(targets...)
+	return NewKafkaStreamContext(context.Background(), c, targets)
+}
+
+// Like NewKafkaStream, but the stream stops as if closed once ctx is done
+func NewKafkaStreamContext(ctx context.Context, c *SimpleConsumer, targets []TopicPartitionOffset) (s *KafkaStream, err error) {
+	return NewKafkaStreamWithConfig(ctx, c, targets, StreamConfig{})
+}
+
+// Like NewKafkaStreamContext, with control over fetch sizes, polling, offset
+// resets and committing
+func NewKafkaStreamWithConfig(ctx context.Context, c *SimpleConsumer, targets []TopicPartitionOffset, config StreamConfig) (s *KafkaStream, err error) {
+	s = newKafkaStream(ctx, c, targets, config)
 	go s.pollLoop()
 	return s, err
 }
+
+func newKafkaStream(ctx context.Context, c *SimpleConsumer, targets []TopicPartitionOffset, config StreamConfig) *KafkaStream {
+	if config.FetchSize <= 0 {
+		config.FetchSize = defaultFetchSize
+	}
+	if config.MinPollInterval <= 0 {
+		config.MinPollInterval = pollTime
+	}
+	if config.MaxPollInterval <= 0 {
+		config.MaxPollInterval = defaultMaxPollInterval
+	}
+	if config.MaxPollInterval < config.MinPollInterval {
+		config.MaxPollInterval = config.MinPollInterval
+	}
+	if config.CommitInterval <= 0 {
+		config.CommitInterval = defaultCommitInterval
+	}
+
+	s := &KafkaStream{
+		c:          c,
+		offsets:    make(topicPartitionOffsetMap),
+		Ch:         make(FetchResponseChan),
+		config:     config,
+		fetchSizes: make(map[TopicPartition]int32),
+		done:       make(chan struct{}),
+		wake:       make(chan struct{}, 1),
+		lastCommit: time.Now(),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.updatePartitionMap(targets...)
+	return s
+}
@@ -1,16 +1,25 @@
 package kafka
 
 import (
+	"bytes"
+	"context"
 	"log"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/kafkatest"
 )
 
 func TestStream(t *testing.T) {
-	c, err := Dial("localhost:9092")
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
 	if err != nil {
 		t.Fatal(err)
 	}
-	c2, err := Dial("localhost:9092")
+	c2, err := Dial(b.Addr)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,3 +118,392 @@ func TestStream(t *testing.T) {
 		t.Fatal("Missing message bar-theres")
 	}
 }
+
+func TestStreamLargeMessage(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := bytes.Repeat([]byte("x"), defaultFetchSize+100)
+	b.Produce("large", 0, large, []byte("small"))
+
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{TopicPartition{"large", 0}, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range [][]byte{large, []byte("small")} {
+		msg := <-s.Ch
+		if msg.Err != nil {
+			t.Fatal(msg.Err)
+		}
+		if !bytes.Equal(msg.Message, expected) {
+			t.Fatal("Expected message of length", len(expected), "got", len(msg.Message))
+		}
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tp := TopicPartition{"foo", 0}
+	first := b.Produce("foo", 0, []byte("hello"))
+	b.Produce("foo", 0, []byte("there"))
+
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{tp, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-s.Ch; res.Err != nil || string(res.Message) != "hello" {
+		t.Fatal("Expected hello. got", res)
+	}
+
+	// Nobody reads "there", which mustn't keep the stream from stopping
+	time.Sleep(10 * time.Millisecond)
+	offsets, err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TopicPartitionOffset{{tp, Offset(first)}}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Error("Expected", expected, "got", offsets)
+	}
+	if _, ok := <-s.Ch; ok {
+		t.Error("Expected Ch to be closed")
+	}
+
+	// The connection is still good
+	if got := fetchAll(t, c, tp); len(got) != 2 {
+		t.Error("Expected 2 messages. got", got)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewKafkaStreamContext(ctx, c, []TopicPartitionOffset{{TopicPartition{"foo", 0}, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the stream to stop")
+	}
+	if _, ok := <-s.Ch; ok {
+		t.Error("Expected Ch to be closed")
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{TopicPartition{"foo", 0}, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	res := <-s.Ch
+	if res.Err != ErrClosed {
+		t.Error("Expected ErrClosed. got", res)
+	}
+	if _, ok := <-s.Ch; ok {
+		t.Error("Expected Ch to be closed")
+	}
+	if _, err = s.Close(); err != ErrClosed {
+		t.Error("Expected Close to return ErrClosed. got", err)
+	}
+}
+
+func expectStreamMessage(t *testing.T, s *KafkaStream, tp TopicPartition, expected string) {
+	select {
+	case res := <-s.Ch:
+		if res.Err != nil || res.TopicPartition != tp || string(res.Message) != expected {
+			t.Fatal("Expected", expected, "from", tp, "got", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected", expected, "from", tp)
+	}
+}
+
+func TestStreamAddRemove(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tp0 := TopicPartition{"foo", 0}
+	tp1 := TopicPartition{"foo", 1}
+	tpbar := TopicPartition{"bar", 0}
+
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{tp0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	b.Produce("foo", 0, []byte("hello"))
+	expectStreamMessage(t, s, tp0, "hello")
+
+	skipped := b.Produce("foo", 1, []byte("skipped"))
+	b.Produce("foo", 1, []byte("there"))
+	s.Add(TopicPartitionOffset{tp1, Offset(skipped)})
+	expectStreamMessage(t, s, tp1, "there")
+
+	s.Remove(tp0)
+	s.Remove(tp1)
+	s.Add(TopicPartitionOffset{tpbar, 0})
+	last := b.Produce("bar", 0, []byte("added"))
+	expectStreamMessage(t, s, tpbar, "added")
+
+	// All three changes went in together, so foo is no longer fetched
+	b.Produce("foo", 0, []byte("removed"))
+	b.Produce("foo", 1, []byte("removed"))
+	select {
+	case res := <-s.Ch:
+		t.Error("Expected nothing from removed partitions. got", res)
+	case <-time.After(3 * pollTime):
+	}
+
+	offsets, err := s.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TopicPartitionOffset{{tpbar, Offset(last)}}
+	if !reflect.DeepEqual(offsets, expected) {
+		t.Error("Expected", expected, "got", offsets)
+	}
+}
+
+func TestStreamPollInterval(t *testing.T) {
+	s := newKafkaStream(context.Background(), nil, nil, StreamConfig{
+		MinPollInterval: 10 * time.Millisecond,
+		MaxPollInterval: 50 * time.Millisecond,
+	})
+
+	for idle, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		s.idle = idle
+		if got := s.pollInterval(); got != expected*time.Millisecond {
+			t.Error("After", idle, "empty polls expected", expected, "ms. got", got)
+		}
+	}
+
+	// The defaults
+	s = newKafkaStream(context.Background(), nil, nil, StreamConfig{})
+	if s.config.MinPollInterval != pollTime || s.config.MaxPollInterval != defaultMaxPollInterval {
+		t.Error("Expected the default intervals. got", s.config)
+	}
+}
+
+func TestStreamConfig(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tpfoo := TopicPartition{"foo", 0}
+	tpbar := TopicPartition{"bar", 0}
+	b.Produce("foo", 0, bytes.Repeat([]byte("x"), 100))
+	b.Produce("bar", 0, bytes.Repeat([]byte("y"), 100))
+
+	// Neither the fetch retried with a bigger size nor the one after a
+	// message should wait for the poll interval
+	s, err := NewKafkaStreamWithConfig(context.Background(), c, []TopicPartitionOffset{{tpfoo, 0}, {tpbar, 0}}, StreamConfig{
+		FetchSize:       1000,
+		TopicFetchSizes: map[string]int32{"foo": 10},
+		MinPollInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[TopicPartition]bool)
+	for len(got) < 2 {
+		select {
+		case res := <-s.Ch:
+			if res.Err != nil || len(res.Message) != 100 {
+				t.Fatal("Expected a 100 byte message. got", res)
+			}
+			got[res.TopicPartition] = true
+		case <-time.After(time.Second):
+			t.Fatal("Expected a message from both topics. got", got)
+		}
+	}
+
+	if _, err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamFetchSizeShrinks(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sizes := make(chan []int32, 100)
+	b.SetFault(func(req kafkatest.Request) kafkatest.Fault {
+		if req.Type == kafkatest.RequestTypeMultiFetch {
+			select {
+			case sizes <- req.FetchSizes:
+			default:
+			}
+		}
+		return kafkatest.Fault{}
+	})
+
+	tp := TopicPartition{"foo", 0}
+	b.Produce("foo", 0, bytes.Repeat([]byte("x"), 100))
+
+	s, err := NewKafkaStreamWithConfig(context.Background(), c, []TopicPartitionOffset{{tp, 0}}, StreamConfig{
+		TopicFetchSizes: map[string]int32{"foo": 10},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	expectStreamMessage(t, s, tp, string(bytes.Repeat([]byte("x"), 100)))
+	b.Produce("foo", 0, []byte("small"))
+	expectStreamMessage(t, s, tp, "small")
+
+	// 10 for foo, grown for the large message, then back to 10
+	var seen []int32
+	for len(seen) < 3 {
+		select {
+		case size := <-sizes:
+			if len(seen) == 0 || seen[len(seen)-1] != size[0] {
+				seen = append(seen, size[0])
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected the fetch size to grow and shrink. got", seen)
+		}
+	}
+	if seen[0] != 10 || seen[1] <= 100 || seen[2] != 10 {
+		t.Error("Expected 10, more than 100 then 10. got", seen)
+	}
+}
+
+func TestStreamOffsetReset(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tp := TopicPartition{"foo", 0}
+	deleted := b.Produce("foo", 0, []byte("deleted"))
+	end := b.Produce("foo", 0, []byte("kept"))
+	b.Truncate("foo", 0, deleted)
+
+	type reset struct{ from, to Offset }
+	for _, test := range []struct {
+		policy   OffsetReset
+		expected string
+		to       int64
+	}{
+		{OffsetResetEarliest, "kept", deleted},
+		{OffsetResetLatest, "new", end},
+	} {
+		resets := make(chan reset, 1)
+		s, err := NewKafkaStreamWithConfig(context.Background(), c, []TopicPartitionOffset{{tp, 0}}, StreamConfig{
+			OffsetReset: test.policy,
+			OnOffsetReset: func(got TopicPartition, from, to Offset) {
+				if got != tp {
+					t.Error("Expected a reset of", tp, "got", got)
+				}
+				resets <- reset{from, to}
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case r := <-resets:
+			if expected := (reset{0, Offset(test.to)}); r != expected {
+				t.Error("Expected", expected, "got", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Expected a reset")
+		}
+
+		if test.policy == OffsetResetLatest {
+			b.Produce("foo", 0, []byte("new"))
+		}
+		expectStreamMessage(t, s, tp, test.expected)
+		if _, err = s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStreamOffsetResetFail(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Close()
+
+	c, err := Dial(b.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	b.Truncate("foo", 0, b.Produce("foo", 0, []byte("deleted")))
+
+	s, err := NewKafkaStream(c, []TopicPartitionOffset{{TopicPartition{"foo", 0}, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := <-s.Ch; res.Err != ErrorCodeOffsetOutOfRange {
+		t.Error("Expected ErrorCodeOffsetOutOfRange. got", res)
+	}
+	if _, err = s.Close(); err != ErrorCodeOffsetOutOfRange {
+		t.Error("Expected Close to return ErrorCodeOffsetOutOfRange. got", err)
+	}
+}
@@ -0,0 +1,780 @@
+// Package zk is a minimal ZooKeeper client, just enough to read the
+// registry Kafka 0.7 keeps there, watch it for changes and keep consumer
+// group state in it.
+//
+// A Conn is a single session on a single server.  There is no failover or
+// session resumption: once the connection is lost every call fails and
+// every outstanding watch gets an EventNotWatching, and it's up to the
+// caller to dial again.
+package zk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var networkOrder = binary.BigEndian
+
+// Error codes the server answers with
+type Error int32
+
+const (
+	ErrSystemError             Error = -1
+	ErrRuntimeInconsistency    Error = -2
+	ErrDataInconsistency       Error = -3
+	ErrConnectionLoss          Error = -4
+	ErrMarshallingError        Error = -5
+	ErrUnimplemented           Error = -6
+	ErrOperationTimeout        Error = -7
+	ErrBadArguments            Error = -8
+	ErrAPIError                Error = -100
+	ErrNoNode                  Error = -101
+	ErrNoAuth                  Error = -102
+	ErrBadVersion              Error = -103
+	ErrNoChildrenForEphemerals Error = -108
+	ErrNodeExists              Error = -110
+	ErrNotEmpty                Error = -111
+	ErrSessionExpired          Error = -112
+	ErrInvalidACL              Error = -114
+	ErrAuthFailed              Error = -115
+)
+
+var errorNames = map[Error]string{
+	ErrSystemError:             "system error",
+	ErrRuntimeInconsistency:    "runtime inconsistency",
+	ErrDataInconsistency:       "data inconsistency",
+	ErrConnectionLoss:          "connection loss",
+	ErrMarshallingError:        "marshalling error",
+	ErrUnimplemented:           "unimplemented",
+	ErrOperationTimeout:        "operation timeout",
+	ErrBadArguments:            "bad arguments",
+	ErrAPIError:                "API error",
+	ErrNoNode:                  "node does not exist",
+	ErrNoAuth:                  "not authenticated",
+	ErrBadVersion:              "bad version",
+	ErrNoChildrenForEphemerals: "ephemeral nodes may not have children",
+	ErrNodeExists:              "node already exists",
+	ErrNotEmpty:                "node has children",
+	ErrSessionExpired:          "session expired",
+	ErrInvalidACL:              "invalid ACL",
+	ErrAuthFailed:              "authentication failed",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return "zk: " + name
+	}
+	return fmt.Sprintf("zk: error %d", int32(e))
+}
+
+// Returned by every call on a Conn once it has been closed
+var ErrClosed = errors.New("zk: connection closed")
+
+type EventType int32
+
+const (
+	EventNodeCreated         EventType = 1
+	EventNodeDeleted         EventType = 2
+	EventNodeDataChanged     EventType = 3
+	EventNodeChildrenChanged EventType = 4
+
+	// Not from the server.  Sent when the connection is lost, after which
+	// the watch will never fire.
+	EventNotWatching EventType = -2
+)
+
+// Delivered once on the channel returned with a watch
+type Event struct {
+	Type EventType
+	Path string
+
+	// Why the watch stopped, for EventNotWatching
+	Err error
+}
+
+// Metadata the server keeps for each node
+type Stat struct {
+	Czxid          int64
+	Mzxid          int64
+	Ctime          int64
+	Mtime          int64
+	Version        int32
+	Cversion       int32
+	Aversion       int32
+	EphemeralOwner int64
+	DataLength     int32
+	NumChildren    int32
+	Pzxid          int64
+}
+
+type opCode int32
+
+const (
+	opCreate      opCode = 1
+	opDelete      opCode = 2
+	opExists      opCode = 3
+	opGetData     opCode = 4
+	opSetData     opCode = 5
+	opGetChildren opCode = 8
+	opPing        opCode = 11
+	opClose       opCode = -11
+)
+
+// Flags for Create
+const (
+	// Deleted when the session that created it ends
+	FlagEphemeral int32 = 1
+	// Appends an increasing counter to the name
+	FlagSequence int32 = 2
+)
+
+// Any version for Set and Delete
+const AnyVersion int32 = -1
+
+const permAll int32 = 31
+
+// Reserved xids
+const (
+	xidWatchEvent int32 = -1
+	xidPing       int32 = -2
+)
+
+type watchKind int
+
+const (
+	watchData watchKind = iota
+	watchExists
+	watchChildren
+)
+
+type watchKey struct {
+	path string
+	kind watchKind
+}
+
+// Which watches each event fires
+var eventWatches = map[EventType][]watchKind{
+	EventNodeCreated:         {watchData, watchExists},
+	EventNodeDataChanged:     {watchData, watchExists},
+	EventNodeDeleted:         {watchData, watchExists, watchChildren},
+	EventNodeChildrenChanged: {watchChildren},
+}
+
+type reply struct {
+	body []byte
+	err  error
+}
+
+type call struct {
+	op    opCode
+	watch *watchKey
+	ch    chan Event
+	reply chan reply
+}
+
+type Conn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	sessionID int64
+	timeout   time.Duration
+
+	// Held while assigning an xid and writing so xids hit the wire in order
+	writeLock sync.Mutex
+	xid       int32
+
+	mu       sync.Mutex
+	pending  map[int32]*call
+	watchers map[watchKey][]chan Event
+	// Set by Close so the server hanging up isn't taken for an error
+	closing bool
+	err     error
+	done    chan struct{}
+}
+
+// Connects to the first of the comma separated servers that answers and
+// starts a session with the given timeout.
+func Dial(servers string, sessionTimeout time.Duration) (c *Conn, err error) {
+	for _, addr := range strings.Split(servers, ",") {
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", strings.TrimSpace(addr), sessionTimeout); err != nil {
+			continue
+		}
+		if c, err = newConn(conn, sessionTimeout); err != nil {
+			conn.Close()
+			continue
+		}
+		return c, nil
+	}
+	return nil, err
+}
+
+func newConn(conn net.Conn, sessionTimeout time.Duration) (c *Conn, err error) {
+	c = &Conn{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		pending:  make(map[int32]*call),
+		watchers: make(map[watchKey][]chan Event),
+		done:     make(chan struct{}),
+	}
+
+	// protocol version, last zxid seen, timeout, session id, password
+	var e encoder
+	e.int32(0)
+	e.int64(0)
+	e.int32(int32(sessionTimeout / time.Millisecond))
+	e.int64(0)
+	e.bytes(make([]byte, 16))
+
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+	if _, err = conn.Write(e.frame()); err != nil {
+		return nil, err
+	}
+
+	body, err := c.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	d := decoder{b: body}
+	d.int32() // protocol version
+	timeout := d.int32()
+	c.sessionID = d.int64()
+	d.bytes() // password
+	if d.err != nil {
+		return nil, d.err
+	}
+	if timeout <= 0 {
+		return nil, ErrSessionExpired
+	}
+	c.timeout = time.Duration(timeout) * time.Millisecond
+
+	go c.readLoop()
+	go c.pingLoop()
+
+	return c, nil
+}
+
+// The session id the server assigned
+func (c *Conn) SessionID() int64 {
+	return c.sessionID
+}
+
+// Why the connection stopped, or nil if it's still up
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Ends the session, which deletes its ephemeral nodes
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.closing = true
+	c.mu.Unlock()
+
+	// Not much to do if it fails, we're closing anyway
+	c.request(opClose, nil)
+	c.stop(ErrClosed)
+	return nil
+}
+
+// Returns the data at path
+func (c *Conn) Get(path string) (data []byte, stat *Stat, err error) {
+	data, stat, _, err = c.get(path, nil)
+	return
+}
+
+// Like Get, and the returned channel gets an event the next time the node
+// changes or is deleted
+func (c *Conn) GetW(path string) (data []byte, stat *Stat, events <-chan Event, err error) {
+	return c.get(path, &watchKey{path, watchData})
+}
+
+func (c *Conn) get(path string, watch *watchKey) (data []byte, stat *Stat, events <-chan Event, err error) {
+	var e encoder
+	e.string(path)
+	e.bool(watch != nil)
+
+	body, events, err := c.watchRequest(opGetData, e.buf, watch)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	d := decoder{b: body}
+	data = d.bytes()
+	stat = d.stat()
+	return data, stat, events, d.err
+}
+
+// Returns the names of path's children
+func (c *Conn) Children(path string) (children []string, err error) {
+	children, _, err = c.children(path, nil)
+	return
+}
+
+// Like Children, and the returned channel gets an event the next time a
+// child is added or removed or the node is deleted
+func (c *Conn) ChildrenW(path string) (children []string, events <-chan Event, err error) {
+	return c.children(path, &watchKey{path, watchChildren})
+}
+
+func (c *Conn) children(path string, watch *watchKey) (children []string, events <-chan Event, err error) {
+	var e encoder
+	e.string(path)
+	e.bool(watch != nil)
+
+	body, events, err := c.watchRequest(opGetChildren, e.buf, watch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d := decoder{b: body}
+	children = make([]string, d.int32())
+	for i := range children {
+		children[i] = d.string()
+	}
+	return children, events, d.err
+}
+
+// Returns whether path exists, and its stat if it does
+func (c *Conn) Exists(path string) (ok bool, stat *Stat, err error) {
+	ok, stat, _, err = c.exists(path, nil)
+	return
+}
+
+// Like Exists, and the returned channel gets an event the next time the
+// node is created, changed or deleted
+func (c *Conn) ExistsW(path string) (ok bool, stat *Stat, events <-chan Event, err error) {
+	return c.exists(path, &watchKey{path, watchExists})
+}
+
+func (c *Conn) exists(path string, watch *watchKey) (ok bool, stat *Stat, events <-chan Event, err error) {
+	var e encoder
+	e.string(path)
+	e.bool(watch != nil)
+
+	body, events, err := c.watchRequest(opExists, e.buf, watch)
+	switch err {
+	case nil:
+	case ErrNoNode:
+		return false, nil, events, nil
+	default:
+		return false, nil, nil, err
+	}
+
+	d := decoder{b: body}
+	stat = d.stat()
+	return true, stat, events, d.err
+}
+
+// Creates path with data, open to everyone.  Returns the path actually
+// created, which differs from path with FlagSequence.
+func (c *Conn) Create(path string, data []byte, flags int32) (created string, err error) {
+	var e encoder
+	e.string(path)
+	e.bytes(data)
+	// A single ACL of world:anyone with every permission
+	e.int32(1)
+	e.int32(permAll)
+	e.string("world")
+	e.string("anyone")
+	e.int32(flags)
+
+	body, err := c.request(opCreate, e.buf)
+	if err != nil {
+		return "", err
+	}
+
+	d := decoder{b: body}
+	created = d.string()
+	return created, d.err
+}
+
+// Creates path and any missing parents with no data.  Doesn't mind if
+// some or all of them exist already.
+func (c *Conn) CreateAll(path string) (err error) {
+	for i := 1; i <= len(path); i++ {
+		if i < len(path) && path[i] != '/' {
+			continue
+		}
+		if _, err = c.Create(path[:i], nil, 0); err != nil && err != ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the data at path if its version matches
+func (c *Conn) Set(path string, data []byte, version int32) (stat *Stat, err error) {
+	var e encoder
+	e.string(path)
+	e.bytes(data)
+	e.int32(version)
+
+	body, err := c.request(opSetData, e.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	d := decoder{b: body}
+	stat = d.stat()
+	return stat, d.err
+}
+
+// Deletes path if its version matches.  It must not have children.
+func (c *Conn) Delete(path string, version int32) (err error) {
+	var e encoder
+	e.string(path)
+	e.int32(version)
+
+	_, err = c.request(opDelete, e.buf)
+	return
+}
+
+func (c *Conn) watchRequest(op opCode, body []byte, watch *watchKey) (resp []byte, events <-chan Event, err error) {
+	var ch chan Event
+	if watch != nil {
+		ch = make(chan Event, 1)
+		events = ch
+	}
+
+	cl := &call{op: op, watch: watch, ch: ch, reply: make(chan reply, 1)}
+	if err = c.send(cl, body); err != nil {
+		return nil, nil, err
+	}
+
+	r := <-cl.reply
+	if r.err != nil && !(r.err == ErrNoNode && op == opExists) {
+		events = nil
+	}
+	return r.body, events, r.err
+}
+
+func (c *Conn) request(op opCode, body []byte) ([]byte, error) {
+	cl := &call{op: op, reply: make(chan reply, 1)}
+	if err := c.send(cl, body); err != nil {
+		return nil, err
+	}
+	r := <-cl.reply
+	return r.body, r.err
+}
+
+func (c *Conn) send(cl *call, body []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return err
+	}
+	c.xid++
+	xid := c.xid
+	c.pending[xid] = cl
+	c.mu.Unlock()
+
+	var e encoder
+	e.int32(xid)
+	e.int32(int32(cl.op))
+	e.buf = append(e.buf, body...)
+
+	if _, err := c.conn.Write(e.frame()); err != nil {
+		// The read loop fails the call along with everything else
+		c.stop(err)
+	}
+	return nil
+}
+
+func (c *Conn) pingLoop() {
+	t := time.NewTicker(c.timeout / 3)
+	defer t.Stop()
+
+	var e encoder
+	e.int32(xidPing)
+	e.int32(int32(opPing))
+	ping := e.frame()
+
+	for {
+		select {
+		case <-t.C:
+		case <-c.done:
+			return
+		}
+
+		c.writeLock.Lock()
+		_, err := c.conn.Write(ping)
+		c.writeLock.Unlock()
+		if err != nil {
+			c.stop(err)
+			return
+		}
+	}
+}
+
+func (c *Conn) readFrame() ([]byte, error) {
+	var size int32
+	if err := binary.Read(c.r, networkOrder, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("zk: bad frame size %d", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func (c *Conn) readLoop() {
+	for {
+		// Pings keep this from expiring as long as the server is there
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		body, err := c.readFrame()
+		if err != nil {
+			c.stop(err)
+			return
+		}
+
+		d := decoder{b: body}
+		xid := d.int32()
+		d.int64() // zxid
+		code := Error(d.int32())
+		if d.err != nil {
+			c.stop(d.err)
+			return
+		}
+
+		switch xid {
+		case xidPing:
+			continue
+		case xidWatchEvent:
+			typ := EventType(d.int32())
+			d.int32() // keeper state
+			path := d.string()
+			if d.err != nil {
+				c.stop(d.err)
+				return
+			}
+			c.fire(Event{Type: typ, Path: path})
+			continue
+		}
+
+		c.mu.Lock()
+		cl := c.pending[xid]
+		delete(c.pending, xid)
+		c.mu.Unlock()
+
+		if cl == nil {
+			c.stop(fmt.Errorf("zk: reply for unknown xid %d", xid))
+			return
+		}
+
+		var r reply
+		if code != 0 {
+			r.err = code
+		} else {
+			r.body = d.b
+		}
+
+		// Register before handing back the reply so no event can slip by
+		if cl.watch != nil && (code == 0 || (code == ErrNoNode && cl.op == opExists)) {
+			c.mu.Lock()
+			c.watchers[*cl.watch] = append(c.watchers[*cl.watch], cl.ch)
+			c.mu.Unlock()
+		}
+		cl.reply <- r
+	}
+}
+
+// Stops sending to channels from the W methods that haven't fired yet, for
+// when nobody will read them.  The server still sends its event, which then
+// goes nowhere.
+func (c *Conn) Unwatch(events ...<-chan Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, events := range events {
+		for key, chs := range c.watchers {
+			for i, ch := range chs {
+				if ch != events {
+					continue
+				}
+				if chs = append(chs[:i], chs[i+1:]...); len(chs) == 0 {
+					delete(c.watchers, key)
+				} else {
+					c.watchers[key] = chs
+				}
+				break
+			}
+		}
+	}
+}
+
+// How many channels from the W methods are waiting for an event
+func (c *Conn) Watches() (n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, chs := range c.watchers {
+		n += len(chs)
+	}
+	return
+}
+
+func (c *Conn) fire(ev Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, kind := range eventWatches[ev.Type] {
+		key := watchKey{ev.Path, kind}
+		for _, ch := range c.watchers[key] {
+			ch <- ev
+		}
+		delete(c.watchers, key)
+	}
+}
+
+// Records why we stopped and fails everything waiting on us
+func (c *Conn) stop(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	if c.closing {
+		err = ErrClosed
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+
+	for xid, cl := range c.pending {
+		cl.reply <- reply{err: err}
+		delete(c.pending, xid)
+	}
+	for key, chs := range c.watchers {
+		for _, ch := range chs {
+			ch <- Event{Type: EventNotWatching, Path: key.path, Err: err}
+		}
+		delete(c.watchers, key)
+	}
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int32(v int32) {
+	e.buf = networkOrder.AppendUint32(e.buf, uint32(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.buf = networkOrder.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) string(s string) {
+	e.int32(int32(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// Prefixes what's been encoded with its length
+func (e *encoder) frame() []byte {
+	return append(networkOrder.AppendUint32(nil, uint32(len(e.buf))), e.buf...)
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		d.b = nil
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) int32() int32 {
+	if p := d.next(4); p != nil {
+		return int32(networkOrder.Uint32(p))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if p := d.next(8); p != nil {
+		return int64(networkOrder.Uint64(p))
+	}
+	return 0
+}
+
+// nil for a length of -1
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n == -1 {
+		return nil
+	}
+	return append([]byte{}, d.next(int(n))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.int32())))
+}
+
+func (d *decoder) stat() *Stat {
+	return &Stat{
+		Czxid:          d.int64(),
+		Mzxid:          d.int64(),
+		Ctime:          d.int64(),
+		Mtime:          d.int64(),
+		Version:        d.int32(),
+		Cversion:       d.int32(),
+		Aversion:       d.int32(),
+		EphemeralOwner: d.int64(),
+		DataLength:     d.int32(),
+		NumChildren:    d.int32(),
+		Pzxid:          d.int64(),
+	}
+}
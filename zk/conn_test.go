@@ -0,0 +1,259 @@
+package zk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikelikespie/go-kafka/zk/zktest"
+)
+
+func newTestServer(t *testing.T) (*zktest.Server, *Conn) {
+	s, err := zktest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Dial(s.Addr, time.Second)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func expectEvent(t *testing.T, events <-chan Event, typ EventType, path string) {
+	select {
+	case ev := <-events:
+		if ev.Type != typ || ev.Path != path {
+			t.Errorf("Expected event %d for %s. got %+v", typ, path, ev)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected event %d for %s. got nothing", typ, path)
+	}
+}
+
+func TestGetAndChildren(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.Set("/brokers/ids/0", []byte("hello"))
+	s.Set("/brokers/ids/1", []byte("there"))
+
+	data, stat, err := c.Get("/brokers/ids/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "there" || stat.DataLength != 5 {
+		t.Error("Expected there. got", string(data), stat)
+	}
+
+	children, err := c.Children("/brokers/ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || children[0] != "0" || children[1] != "1" {
+		t.Error("Expected 0 and 1. got", children)
+	}
+
+	if _, _, err = c.Get("/nope"); err != ErrNoNode {
+		t.Error("Expected ErrNoNode. got", err)
+	}
+
+	ok, _, err := c.Exists("/brokers")
+	if err != nil || !ok {
+		t.Error("Expected /brokers to exist. got", ok, err)
+	}
+	ok, _, err = c.Exists("/nope")
+	if err != nil || ok {
+		t.Error("Expected /nope not to exist. got", ok, err)
+	}
+}
+
+func TestWatches(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.Set("/a", []byte("1"))
+
+	_, _, dataEvents, err := c.GetW("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, childEvents, err := c.ChildrenW("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, _, existsEvents, err := c.ExistsW("/b")
+	if err != nil || ok {
+		t.Fatal("Expected /b not to exist. got", ok, err)
+	}
+
+	s.Set("/a", []byte("2"))
+	expectEvent(t, dataEvents, EventNodeDataChanged, "/a")
+
+	s.Set("/a/child", nil)
+	expectEvent(t, childEvents, EventNodeChildrenChanged, "/a")
+
+	s.Set("/b", nil)
+	expectEvent(t, existsEvents, EventNodeCreated, "/b")
+
+	// Watches only fire once
+	s.Set("/a", []byte("3"))
+	select {
+	case ev := <-dataEvents:
+		t.Error("Expected no second event. got", ev)
+	default:
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	s.Set("/a", nil)
+	_, _, events, err := c.GetW("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.DropConnections()
+
+	select {
+	case ev := <-events:
+		if ev.Type != EventNotWatching || ev.Err == nil {
+			t.Error("Expected EventNotWatching with an error. got", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the watch to be cancelled")
+	}
+
+	if _, _, err = c.Get("/a"); err == nil || err != c.Err() {
+		t.Error("Expected the connection's error. got", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Get("/"); err != ErrClosed {
+		t.Error("Expected ErrClosed. got", err)
+	}
+}
+
+func TestCreateSetDelete(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	if err := c.CreateAll("/consumers/group/ids"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateAll("/consumers/group/ids"); err != nil {
+		t.Error("Expected CreateAll to not mind existing nodes. got", err)
+	}
+
+	if _, err := c.Create("/nope/child", nil, 0); err != ErrNoNode {
+		t.Error("Expected ErrNoNode for a missing parent. got", err)
+	}
+
+	path, err := c.Create("/consumers/group/ids/seq-", []byte("a"), FlagSequence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/consumers/group/ids/seq-0000000000" {
+		t.Error("Expected a sequence number. got", path)
+	}
+	if _, err = c.Create(path, nil, 0); err != ErrNodeExists {
+		t.Error("Expected ErrNodeExists. got", err)
+	}
+
+	stat, err := c.Set(path, []byte("b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Version != 1 {
+		t.Error("Expected version 1. got", stat.Version)
+	}
+	if _, err = c.Set(path, []byte("c"), 0); err != ErrBadVersion {
+		t.Error("Expected ErrBadVersion. got", err)
+	}
+	if data, _ := s.Get(path); string(data) != "b" {
+		t.Error("Expected b. got", string(data))
+	}
+
+	if err = c.Delete("/consumers/group", AnyVersion); err != ErrNotEmpty {
+		t.Error("Expected ErrNotEmpty. got", err)
+	}
+	if err = c.Delete(path, AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get(path); ok {
+		t.Error("Expected", path, "to be deleted")
+	}
+}
+
+func TestEphemeral(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	other, err := Dial(s.Addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = other.Create("/owner", []byte("other"), FlagEphemeral); err != nil {
+		t.Fatal(err)
+	}
+	_, stat, events, err := c.GetW("/owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.EphemeralOwner != other.SessionID() {
+		t.Error("Expected the other session to own it. got", stat.EphemeralOwner)
+	}
+
+	other.Close()
+	expectEvent(t, events, EventNodeDeleted, "/owner")
+}
+
+func TestUnwatch(t *testing.T) {
+	s, c := newTestServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.Set("/a", nil)
+	_, _, events, err := c.GetW("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, kept, err := c.GetW("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Watches(); n != 2 {
+		t.Fatal("Expected 2 watches. got", n)
+	}
+
+	c.Unwatch(events)
+	if n := c.Watches(); n != 1 {
+		t.Error("Expected 1 watch. got", n)
+	}
+
+	s.Set("/a", []byte("1"))
+	expectEvent(t, kept, EventNodeDataChanged, "/a")
+	select {
+	case ev := <-events:
+		t.Error("Expected no event after Unwatch. got", ev)
+	default:
+	}
+	if n := c.Watches(); n != 0 {
+		t.Error("Expected no watches. got", n)
+	}
+}
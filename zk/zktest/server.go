@@ -0,0 +1,675 @@
+// Package zktest provides an in-memory ZooKeeper server for tests.
+//
+// It speaks the subset of the protocol the zk package uses: sessions,
+// pings, create, delete, exists, getData, setData and getChildren with
+// watches.  Tests can also edit the tree directly through Set and Delete,
+// which fire watches the way a real server would.  A session ends as soon as
+// its connection does, taking its ephemeral nodes with it.
+//
+// Like kafkatest it has its own encoding rather than importing zk, so it
+// checks the client against the wire format and not against itself.
+package zktest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var networkOrder = binary.BigEndian
+
+const (
+	opCreate      int32 = 1
+	opDelete      int32 = 2
+	opExists      int32 = 3
+	opGetData     int32 = 4
+	opSetData     int32 = 5
+	opGetChildren int32 = 8
+	opPing        int32 = 11
+	opClose       int32 = -11
+)
+
+const (
+	errUnimplemented           int32 = -6
+	errBadArguments            int32 = -8
+	errNoNode                  int32 = -101
+	errBadVersion              int32 = -103
+	errNoChildrenForEphemerals int32 = -108
+	errNodeExists              int32 = -110
+	errNotEmpty                int32 = -111
+)
+
+const (
+	flagEphemeral int32 = 1
+	flagSequence  int32 = 2
+)
+
+const (
+	eventNodeCreated         int32 = 1
+	eventNodeDeleted         int32 = 2
+	eventNodeDataChanged     int32 = 3
+	eventNodeChildrenChanged int32 = 4
+)
+
+const stateSyncConnected int32 = 3
+
+type node struct {
+	data     []byte
+	children map[string]bool
+
+	czxid, mzxid, pzxid int64
+	ctime, mtime        int64
+	version, cversion   int32
+	// Session of an ephemeral node
+	owner int64
+}
+
+type watchKind int
+
+const (
+	watchData watchKind = iota
+	watchChildren
+)
+
+type session struct {
+	id   int64
+	conn net.Conn
+
+	// Serializes replies and events
+	writeLock sync.Mutex
+}
+
+type Server struct {
+	Addr string
+	ln   net.Listener
+
+	mu       sync.Mutex
+	zxid     int64
+	nodes    map[string]*node
+	sessions map[int64]*session
+	lastID   int64
+	// Sessions waiting on each path, one-shot like the real thing
+	watches map[string]map[watchKind]map[*session]bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Starts a server on a random loopback port with just the root node
+func NewServer() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr:     ln.Addr().String(),
+		ln:       ln,
+		nodes:    map[string]*node{"/": {children: make(map[string]bool)}},
+		sessions: make(map[int64]*session),
+		watches:  make(map[string]map[watchKind]map[*session]bool),
+		done:     make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	return s, nil
+}
+
+// Stops listening, drops every session and waits for them to finish
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+
+	close(s.done)
+	err := s.ln.Close()
+	s.DropConnections()
+	s.wg.Wait()
+	return err
+}
+
+// Closes every client connection.  The server keeps listening.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sess := range s.sessions {
+		sess.conn.Close()
+	}
+}
+
+// Sets the data at path, creating it and any missing parents
+func (s *Server) Set(path string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.zxid++
+	if n := s.nodes[path]; n != nil {
+		s.setData(path, n, data)
+		return
+	}
+
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' && s.nodes[path[:i]] == nil {
+			s.create(path[:i], nil, 0)
+		}
+	}
+	s.create(path, data, 0)
+}
+
+// Must hold mu
+func (s *Server) setData(path string, n *node, data []byte) {
+	n.data = append([]byte(nil), data...)
+	n.mzxid = s.zxid
+	n.mtime = time.Now().UnixMilli()
+	n.version++
+	s.fire(path, watchData, eventNodeDataChanged)
+}
+
+// Adds path under its existing parent.  Must hold mu.
+func (s *Server) create(path string, data []byte, owner int64) {
+	parentPath, name := split(path)
+	parent := s.nodes[parentPath]
+
+	now := time.Now().UnixMilli()
+	s.nodes[path] = &node{
+		data:     append([]byte(nil), data...),
+		children: make(map[string]bool),
+		czxid:    s.zxid,
+		mzxid:    s.zxid,
+		pzxid:    s.zxid,
+		ctime:    now,
+		mtime:    now,
+		owner:    owner,
+	}
+
+	parent.children[name] = true
+	parent.cversion++
+	parent.pzxid = s.zxid
+
+	s.fire(path, watchData, eventNodeCreated)
+	s.fire(parentPath, watchChildren, eventNodeChildrenChanged)
+}
+
+// Deletes path and everything under it
+func (s *Server) Delete(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodes[path] == nil || path == "/" {
+		return
+	}
+	s.zxid++
+	s.delete(path)
+}
+
+// Must hold mu
+func (s *Server) delete(path string) {
+	for child := range s.nodes[path].children {
+		s.delete(join(path, child))
+	}
+	delete(s.nodes, path)
+
+	parentPath, name := split(path)
+	parent := s.nodes[parentPath]
+	delete(parent.children, name)
+	parent.cversion++
+	parent.pzxid = s.zxid
+
+	s.fire(path, watchData, eventNodeDeleted)
+	s.fire(path, watchChildren, eventNodeDeleted)
+	s.fire(parentPath, watchChildren, eventNodeChildrenChanged)
+}
+
+// Returns the data at path and whether it exists
+func (s *Server) Get(path string) (data []byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nodes[path]
+	if n == nil {
+		return nil, false
+	}
+	return append([]byte(nil), n.data...), true
+}
+
+func split(path string) (parent, name string) {
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/", path[1:]
+	}
+	return path[:i], path[i+1:]
+}
+
+func join(parent, name string) string {
+	if parent == "/" {
+		return "/" + name
+	}
+	return parent + "/" + name
+}
+
+// Must hold mu
+func (s *Server) watch(sess *session, path string, kind watchKind) {
+	kinds := s.watches[path]
+	if kinds == nil {
+		kinds = make(map[watchKind]map[*session]bool)
+		s.watches[path] = kinds
+	}
+	if kinds[kind] == nil {
+		kinds[kind] = make(map[*session]bool)
+	}
+	kinds[kind][sess] = true
+}
+
+// Sends typ to every session watching path for kind.  Must hold mu.
+func (s *Server) fire(path string, kind watchKind, typ int32) {
+	for sess := range s.watches[path][kind] {
+		var e []byte
+		e = appendInt32(e, -1) // xid
+		e = appendInt64(e, s.zxid)
+		e = appendInt32(e, 0) // error
+		e = appendInt32(e, typ)
+		e = appendInt32(e, stateSyncConnected)
+		e = appendString(e, path)
+		sess.write(e)
+	}
+	delete(s.watches[path], kind)
+}
+
+func (sess *session) write(body []byte) error {
+	sess.writeLock.Lock()
+	defer sess.writeLock.Unlock()
+
+	_, err := sess.conn.Write(append(appendInt32(nil, int32(len(body))), body...))
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-s.done:
+			conn.Close()
+			return
+		default:
+		}
+
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size int32
+	if err := binary.Read(r, networkOrder, &size); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	body := make([]byte, size)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	body, err := readFrame(r)
+	if err != nil {
+		return
+	}
+	d := &decoder{b: body}
+	d.int32() // protocol version
+	d.int64() // last zxid seen
+	timeout := d.int32()
+	if d.err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return
+	default:
+	}
+	s.lastID++
+	sess := &session{id: s.lastID, conn: conn}
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+
+	defer s.endSession(sess)
+
+	var resp []byte
+	resp = appendInt32(resp, 0) // protocol version
+	resp = appendInt32(resp, timeout)
+	resp = appendInt64(resp, sess.id)
+	resp = appendBytes(resp, make([]byte, 16))
+	if sess.write(resp) != nil {
+		return
+	}
+
+	for {
+		body, err := readFrame(r)
+		if err != nil {
+			return
+		}
+
+		d := &decoder{b: body}
+		xid := d.int32()
+		op := d.int32()
+		if d.err != nil {
+			return
+		}
+
+		resp, code := s.handle(sess, op, d)
+		if d.err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		zxid := s.zxid
+		s.mu.Unlock()
+
+		var reply []byte
+		reply = appendInt32(reply, xid)
+		reply = appendInt64(reply, zxid)
+		reply = appendInt32(reply, code)
+		if code == 0 {
+			reply = append(reply, resp...)
+		}
+		if sess.write(reply) != nil || op == opClose {
+			return
+		}
+	}
+}
+
+func (s *Server) endSession(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, sess.id)
+
+	var ephemerals []string
+	for path, n := range s.nodes {
+		if n.owner == sess.id {
+			ephemerals = append(ephemerals, path)
+		}
+	}
+	if len(ephemerals) > 0 {
+		s.zxid++
+		for _, path := range ephemerals {
+			s.delete(path)
+		}
+	}
+
+	for _, kinds := range s.watches {
+		for _, sessions := range kinds {
+			delete(sessions, sess)
+		}
+	}
+}
+
+func (s *Server) handle(sess *session, op int32, d *decoder) (resp []byte, code int32) {
+	switch op {
+	case opPing, opClose:
+		return nil, 0
+	case opCreate:
+		return s.handleCreate(sess, d)
+	case opDelete:
+		return s.handleDelete(d)
+	case opSetData:
+		return s.handleSetData(d)
+	case opExists, opGetData, opGetChildren:
+	default:
+		return nil, errUnimplemented
+	}
+
+	path := d.string()
+	watch := d.bool()
+	if d.err != nil {
+		return nil, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nodes[path]
+	if n == nil {
+		if watch && op == opExists {
+			s.watch(sess, path, watchData)
+		}
+		return nil, errNoNode
+	}
+
+	switch op {
+	case opExists:
+		if watch {
+			s.watch(sess, path, watchData)
+		}
+		return n.appendStat(nil), 0
+	case opGetData:
+		if watch {
+			s.watch(sess, path, watchData)
+		}
+		resp = appendBytes(nil, n.data)
+		return n.appendStat(resp), 0
+	default:
+		if watch {
+			s.watch(sess, path, watchChildren)
+		}
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		resp = appendInt32(nil, int32(len(names)))
+		for _, name := range names {
+			resp = appendString(resp, name)
+		}
+		return resp, 0
+	}
+}
+
+func (s *Server) handleCreate(sess *session, d *decoder) (resp []byte, code int32) {
+	path := d.string()
+	data := d.bytes()
+	for i, n := d.int32(), int32(0); n < i; n++ {
+		d.int32()  // perms
+		d.string() // scheme
+		d.string() // id
+	}
+	flags := d.int32()
+	if d.err != nil {
+		return nil, 0
+	}
+	if path == "/" || !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return nil, errBadArguments
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parentPath, _ := split(path)
+	parent := s.nodes[parentPath]
+	switch {
+	case parent == nil:
+		return nil, errNoNode
+	case parent.owner != 0:
+		return nil, errNoChildrenForEphemerals
+	}
+
+	if flags&flagSequence != 0 {
+		path = fmt.Sprintf("%s%010d", path, parent.cversion)
+	}
+	if s.nodes[path] != nil {
+		return nil, errNodeExists
+	}
+
+	var owner int64
+	if flags&flagEphemeral != 0 {
+		owner = sess.id
+	}
+
+	s.zxid++
+	s.create(path, data, owner)
+	return appendString(nil, path), 0
+}
+
+func (s *Server) handleDelete(d *decoder) (resp []byte, code int32) {
+	path := d.string()
+	version := d.int32()
+	if d.err != nil {
+		return nil, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nodes[path]
+	switch {
+	case n == nil:
+		return nil, errNoNode
+	case path == "/":
+		return nil, errBadArguments
+	case version != -1 && version != n.version:
+		return nil, errBadVersion
+	case len(n.children) > 0:
+		return nil, errNotEmpty
+	}
+
+	s.zxid++
+	s.delete(path)
+	return nil, 0
+}
+
+func (s *Server) handleSetData(d *decoder) (resp []byte, code int32) {
+	path := d.string()
+	data := d.bytes()
+	version := d.int32()
+	if d.err != nil {
+		return nil, 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.nodes[path]
+	switch {
+	case n == nil:
+		return nil, errNoNode
+	case version != -1 && version != n.version:
+		return nil, errBadVersion
+	}
+
+	s.zxid++
+	s.setData(path, n, data)
+	return n.appendStat(nil), 0
+}
+
+func (n *node) appendStat(b []byte) []byte {
+	b = appendInt64(b, n.czxid)
+	b = appendInt64(b, n.mzxid)
+	b = appendInt64(b, n.ctime)
+	b = appendInt64(b, n.mtime)
+	b = appendInt32(b, n.version)
+	b = appendInt32(b, n.cversion)
+	b = appendInt32(b, 0) // aversion
+	b = appendInt64(b, n.owner)
+	b = appendInt32(b, int32(len(n.data)))
+	b = appendInt32(b, int32(len(n.children)))
+	return appendInt64(b, n.pzxid)
+}
+
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		d.b = nil
+		return nil
+	}
+	p := d.b[:n]
+	d.b = d.b[n:]
+	return p
+}
+
+func (d *decoder) int32() int32 {
+	if p := d.next(4); p != nil {
+		return int32(networkOrder.Uint32(p))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if p := d.next(8); p != nil {
+		return int64(networkOrder.Uint64(p))
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool {
+	if p := d.next(1); p != nil {
+		return p[0] != 0
+	}
+	return false
+}
+
+// nil for a length of -1
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n == -1 {
+		return nil
+	}
+	return append([]byte(nil), d.next(int(n))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.int32())))
+}
+
+func appendInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	return appendInt32(appendInt32(b, int32(v>>32)), int32(v))
+}
+
+func appendBytes(b []byte, p []byte) []byte {
+	if p == nil {
+		return appendInt32(b, -1)
+	}
+	return append(appendInt32(b, int32(len(p))), p...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendInt32(b, int32(len(s))), s...)
+}